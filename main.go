@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"virtualization-manager/pkg/auth"
 	"virtualization-manager/pkg/config"
 	"virtualization-manager/pkg/gateway"
+	"virtualization-manager/pkg/invocations"
 	"virtualization-manager/pkg/manager"
-	"virtualization-manager/pkg/registry"
+	"virtualization-manager/pkg/ratelimit"
 	"virtualization-manager/pkg/redis"
+	"virtualization-manager/pkg/registry"
 
 	"github.com/gorilla/mux"
 )
@@ -24,36 +28,102 @@ func main() {
 	redisClient := redis.NewClient(cfg.Redis)
 
 	// Initialize core components
-	connectionManager := manager.NewConnectionManager(redisClient)
-	functionRegistry := registry.NewFunctionRegistry(redisClient)
-	sseGateway := gateway.NewSSEGateway(connectionManager, functionRegistry)
+	connectionManager := manager.NewConnectionManager(redisClient, cfg)
+	functionRegistry := registry.NewFunctionRegistry(redisClient, cfg)
+	if cfg.Functions.File != "" {
+		functionSource, err := registry.NewFileSource(functionRegistry, cfg.Functions)
+		if err != nil {
+			log.Fatalf("Failed to configure function definitions: %v", err)
+		}
+		if err := functionSource.Start(); err != nil {
+			log.Fatalf("Failed to load function definitions: %v", err)
+		}
+	}
+	invocationStore := invocations.NewStore(redisClient, cfg)
+	rateLimiter, err := ratelimit.NewLimiter(redisClient, cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure rate limits: %v", err)
+	}
+	sseGateway := gateway.NewSSEGateway(connectionManager, functionRegistry, invocationStore, rateLimiter, cfg)
+
+	// Authentication for client-facing endpoints
+	authenticator, err := auth.NewAuthenticator(cfg.Auth)
+	if err != nil {
+		log.Fatalf("Failed to configure authentication: %v", err)
+	}
+	authenticate := auth.Middleware(authenticator)
+	tickets := auth.NewTicketService(redisClient, cfg.Auth)
+	authenticateStream := tickets.Middleware(authenticator)
+
+	// Authentication and roles for the admin API
+	adminAuth, err := auth.NewAdminAuthenticator(redisClient, cfg.Auth, authenticator)
+	if err != nil {
+		log.Fatalf("Failed to configure admin authentication: %v", err)
+	}
+	viewer := adminAuth.Require(auth.RoleViewer)
+	operator := adminAuth.Require(auth.RoleOperator)
+	admin := adminAuth.Require(auth.RoleAdmin)
 
 	// Setup HTTP router
 	router := mux.NewRouter()
-	
+
 	// SSE endpoint
-	router.HandleFunc("/sse/{clientId}", sseGateway.HandleSSEConnection).Methods("GET")
-	
+	router.Handle("/sse/{clientId}", authenticateStream(http.HandlerFunc(sseGateway.HandleSSEConnection))).Methods("GET")
+
+	// WebSocket endpoint
+	router.Handle("/ws/{clientId}", authenticateStream(http.HandlerFunc(sseGateway.HandleWebSocketConnection))).Methods("GET")
+
+	// Long-polling endpoint
+	router.Handle("/poll/{clientId}", authenticate(http.HandlerFunc(sseGateway.HandleLongPoll))).Methods("GET")
+
+	// Connection tickets for browser clients
+	router.Handle("/auth/ticket", authenticate(http.HandlerFunc(tickets.IssueTicket))).Methods("POST")
+
 	// Admin endpoints
-	router.HandleFunc("/admin/connections", sseGateway.GetConnections).Methods("GET")
-	router.HandleFunc("/admin/health", sseGateway.HealthCheck).Methods("GET")
-	router.HandleFunc("/admin/functions", functionRegistry.GetFunctions).Methods("GET")
-	router.HandleFunc("/admin/functions", functionRegistry.RegisterFunction).Methods("POST")
-	
+	router.Handle("/admin/connections", viewer(http.HandlerFunc(sseGateway.GetConnections))).Methods("GET")
+	router.Handle("/admin/health", adminAuth.Optional(http.HandlerFunc(sseGateway.HealthCheck))).Methods("GET")
+	router.Handle("/admin/functions", viewer(http.HandlerFunc(functionRegistry.GetFunctions))).Methods("GET")
+	router.Handle("/admin/functions", operator(http.HandlerFunc(functionRegistry.RegisterFunction))).Methods("POST")
+	router.Handle("/admin/functions/{name}", viewer(http.HandlerFunc(functionRegistry.DescribeFunction))).Methods("GET")
+	router.Handle("/admin/functions/{name}", operator(http.HandlerFunc(functionRegistry.ReplaceFunction))).Methods("PUT")
+	router.Handle("/admin/functions/{name}", operator(http.HandlerFunc(functionRegistry.PatchFunction))).Methods("PATCH")
+	router.Handle("/admin/functions/{name}", operator(http.HandlerFunc(functionRegistry.DeleteFunction))).Methods("DELETE")
+	router.Handle("/admin/functions/{name}/enable", operator(http.HandlerFunc(functionRegistry.EnableFunction))).Methods("POST")
+	router.Handle("/admin/functions/{name}/disable", operator(http.HandlerFunc(functionRegistry.DisableFunction))).Methods("POST")
+	router.Handle("/admin/functions/{name}/versions", operator(http.HandlerFunc(functionRegistry.AddVersion))).Methods("POST")
+	router.Handle("/admin/functions/{name}/versions/{version}", operator(http.HandlerFunc(functionRegistry.RemoveVersion))).Methods("DELETE")
+	router.Handle("/admin/functions/{name}/traffic", operator(http.HandlerFunc(functionRegistry.SetTraffic))).Methods("PUT")
+	router.Handle("/admin/functions/{name}/rollback", operator(http.HandlerFunc(functionRegistry.Rollback))).Methods("POST")
+	router.Handle("/admin/functions/{name}/revisions", viewer(http.HandlerFunc(functionRegistry.GetRevisions))).Methods("GET")
+	router.Handle("/admin/functions/{name}/aliases/{alias}", operator(http.HandlerFunc(functionRegistry.SetAlias))).Methods("PUT")
+	router.Handle("/admin/functions/{name}/aliases/{alias}", operator(http.HandlerFunc(functionRegistry.DeleteAlias))).Methods("DELETE")
+	router.Handle("/admin/functions/{name}/aliases/{alias}/rollback", operator(http.HandlerFunc(functionRegistry.RollbackAlias))).Methods("POST")
+	router.Handle("/admin/keys", admin(http.HandlerFunc(adminAuth.ListKeys))).Methods("GET")
+	router.Handle("/admin/keys", admin(http.HandlerFunc(adminAuth.CreateKey))).Methods("POST")
+	router.Handle("/admin/keys/{keyId}", admin(http.HandlerFunc(adminAuth.RevokeKey))).Methods("DELETE")
+
 	// Function invocation endpoint
-	router.HandleFunc("/invoke/{functionName}", sseGateway.InvokeFunction).Methods("POST")
+	router.Handle("/invoke/{functionName}", authenticate(http.HandlerFunc(sseGateway.InvokeFunction))).Methods("POST")
+
+	// Topic endpoints
+	router.Handle("/publish/{topic}", authenticate(http.HandlerFunc(sseGateway.PublishToTopic))).Methods("POST")
+	router.Handle("/connections/{connectionId}/topics", authenticate(http.HandlerFunc(sseGateway.SubscribeTopics))).Methods("POST")
+	router.Handle("/connections/{connectionId}/topics/{topic}", authenticate(http.HandlerFunc(sseGateway.UnsubscribeTopic))).Methods("DELETE")
+
+	// Invocation status endpoint
+	router.Handle("/invocations/{requestId}", authenticate(http.HandlerFunc(invocationStore.GetInvocation))).Methods("GET")
 
 	// Enable CORS
 	router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-			
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, Idempotency-Key")
+
 			if r.Method == "OPTIONS" {
 				return
 			}
-			
+
 			next.ServeHTTP(w, r)
 		})
 	})
@@ -78,6 +148,23 @@ func main() {
 	<-c
 
 	log.Println("Shutting down gracefully...")
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.DrainTimeout)
+	defer cancel()
+
+	// Stop accepting new connections and tell clients to reconnect elsewhere
+	sseGateway.StartDrain()
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- server.Shutdown(ctx)
+	}()
+
+	// Let in-flight invocations and queued messages finish, then close the
+	// remaining streams so the HTTP server can complete its shutdown
+	sseGateway.WaitForDrain(ctx)
 	connectionManager.Shutdown()
+
+	if err := <-shutdownDone; err != nil {
+		log.Printf("HTTP server shutdown did not complete cleanly: %v", err)
+	}
 	log.Println("Server stopped")
 }
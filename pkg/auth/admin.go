@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"virtualization-manager/pkg/config"
+	"virtualization-manager/pkg/redis"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Role grants access to a group of admin endpoints. Roles are ordered:
+// each one includes the permissions of the roles below it.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var roleLevels = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// Allows reports whether the role includes the required role
+func (r Role) Allows(required Role) bool {
+	return roleLevels[r] >= roleLevels[required] && roleLevels[r] > 0
+}
+
+// HasRole reports whether the request context carries at least the role
+func HasRole(ctx context.Context, required Role) bool {
+	identity := IdentityFromContext(ctx)
+	return identity != nil && identity.Role.Allows(required)
+}
+
+// AdminKey is a stored admin API key. The secret itself is never stored.
+type AdminKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      Role      `json:"role"`
+	Prefix    string    `json:"prefix"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+// AdminKeyRequest is the body of POST /admin/keys
+type AdminKeyRequest struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+// AdminAuthenticator protects the admin API with API keys stored in Redis,
+// a bootstrap key from the environment, or, if an admin audience is
+// configured, JWTs issued to that audience carrying a role claim
+type AdminAuthenticator struct {
+	redisClient  *redis.Client
+	enabled      bool
+	bootstrapKey string
+	roleClaim    string
+	audience     string
+	jwt          Authenticator
+}
+
+func NewAdminAuthenticator(redisClient *redis.Client, cfg config.AuthConfig, jwt Authenticator) (*AdminAuthenticator, error) {
+	aa := &AdminAuthenticator{
+		redisClient:  redisClient,
+		bootstrapKey: cfg.AdminAPIKey,
+		roleClaim:    cfg.AdminRoleClaim,
+		audience:     cfg.AdminJWTAudience,
+		jwt:          jwt,
+	}
+
+	// Client tokens must never double as admin tokens
+	if aa.audience != "" && aa.audience == cfg.JWTAudience {
+		return nil, errors.New("ADMIN_JWT_AUDIENCE must differ from JWT_AUDIENCE")
+	}
+
+	switch cfg.AdminMode {
+	case "none":
+		log.Println("Admin API authentication disabled")
+	case "", "apikey":
+		aa.enabled = true
+		if aa.bootstrapKey == "" {
+			log.Println("ADMIN_API_KEY not set, only keys stored in Redis can access the admin API")
+		}
+	default:
+		return nil, fmt.Errorf("unknown ADMIN_AUTH %q", cfg.AdminMode)
+	}
+
+	return aa, nil
+}
+
+// Require rejects requests without credentials for at least the given role
+func (aa *AdminAuthenticator) Require(role Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, err := aa.authenticate(r)
+			if err != nil {
+				WriteAuthError(w, err)
+				return
+			}
+
+			if !identity.Role.Allows(role) {
+				http.Error(w, fmt.Sprintf("Role %q is required", role), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+		})
+	}
+}
+
+// Optional attaches the admin identity when valid credentials are present
+// and lets every request through
+func (aa *AdminAuthenticator) Optional(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity, err := aa.authenticate(r); err == nil {
+			r = r.WithContext(WithIdentity(r.Context(), identity))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (aa *AdminAuthenticator) authenticate(r *http.Request) (*Identity, error) {
+	if !aa.enabled {
+		return &Identity{Subject: "anonymous", Role: RoleAdmin}, nil
+	}
+
+	credential := r.Header.Get("X-API-Key")
+	if credential == "" {
+		token, err := bearerToken(r)
+		if err != nil {
+			return nil, err
+		}
+		credential = token
+	}
+
+	if aa.bootstrapKey != "" && subtle.ConstantTimeCompare([]byte(credential), []byte(aa.bootstrapKey)) == 1 {
+		return &Identity{Subject: "bootstrap", Role: RoleAdmin}, nil
+	}
+
+	key, err := aa.lookupKey(credential)
+	if err == nil {
+		return &Identity{Subject: "key:" + key.ID, Role: key.Role}, nil
+	}
+	if err != goredis.Nil {
+		log.Printf("Failed to look up admin key: %v", err)
+	}
+
+	// Fall back to a JWT issued for the admin API with a role claim
+	if aa.jwt != nil && aa.audience != "" && strings.Count(credential, ".") == 2 {
+		if verifier, ok := aa.jwt.(*JWTAuthenticator); ok {
+			identity, err := verifier.VerifyAudience(credential, aa.audience)
+			if err != nil {
+				return nil, err
+			}
+			role, _ := identity.Claims[aa.roleClaim].(string)
+			identity.Role = Role(role)
+			return identity, nil
+		}
+	}
+
+	return nil, errors.New("unknown or revoked API key")
+}
+
+func (aa *AdminAuthenticator) lookupKey(secret string) (*AdminKey, error) {
+	data, err := aa.redisClient.GetAdminKey(hashKey(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	var key AdminKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// CreateKey mints a new API key. The secret is only returned once.
+func (aa *AdminAuthenticator) CreateKey(w http.ResponseWriter, r *http.Request) {
+	var request AdminKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if request.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if _, valid := roleLevels[request.Role]; !valid {
+		http.Error(w, "role must be one of viewer, operator, admin", http.StatusBadRequest)
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, "Failed to generate key", http.StatusInternalServerError)
+		return
+	}
+	secret := "sk_" + base64.RawURLEncoding.EncodeToString(raw)
+
+	key := AdminKey{
+		ID:        uuid.New().String(),
+		Name:      request.Name,
+		Role:      request.Role,
+		Prefix:    secret[:8],
+		CreatedAt: time.Now(),
+	}
+	if identity := IdentityFromContext(r.Context()); identity != nil {
+		key.CreatedBy = identity.Subject
+	}
+
+	if err := aa.redisClient.StoreAdminKey(hashKey(secret), key); err != nil {
+		http.Error(w, "Failed to store key", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Created admin key %s (%s) with role %s", key.ID, key.Name, key.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":    secret,
+		"id":     key.ID,
+		"name":   key.Name,
+		"role":   key.Role,
+		"prefix": key.Prefix,
+	})
+}
+
+// ListKeys returns the stored keys without their secrets
+func (aa *AdminAuthenticator) ListKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := aa.allKeys()
+	if err != nil {
+		http.Error(w, "Failed to load keys", http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]AdminKey, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, key)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys":  list,
+		"count": len(list),
+	})
+}
+
+// RevokeKey deletes a key; it stops working on every replica immediately
+func (aa *AdminAuthenticator) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	keyID := mux.Vars(r)["keyId"]
+
+	keys, err := aa.allKeys()
+	if err != nil {
+		http.Error(w, "Failed to load keys", http.StatusInternalServerError)
+		return
+	}
+
+	for keyHash, key := range keys {
+		if key.ID != keyID {
+			continue
+		}
+
+		if err := aa.redisClient.DeleteAdminKey(keyHash); err != nil {
+			http.Error(w, "Failed to revoke key", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Revoked admin key %s (%s)", key.ID, key.Name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	http.Error(w, "Key not found: "+keyID, http.StatusNotFound)
+}
+
+// allKeys returns the stored keys indexed by secret hash
+func (aa *AdminAuthenticator) allKeys() (map[string]AdminKey, error) {
+	entries, err := aa.redisClient.GetAllAdminKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]AdminKey, len(entries))
+	for keyHash, data := range entries {
+		var key AdminKey
+		if err := json.Unmarshal([]byte(data), &key); err == nil {
+			keys[keyHash] = key
+		}
+	}
+	return keys, nil
+}
+
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
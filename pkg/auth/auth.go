@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"virtualization-manager/pkg/config"
+)
+
+// Identity is the verified caller of a request
+type Identity struct {
+	Subject string                 `json:"sub"`
+	Role    Role                   `json:"role,omitempty"`
+	Claims  map[string]interface{} `json:"claims"`
+}
+
+// Authenticator verifies the credentials on a request. Implementations
+// return ErrMissingCredentials when the request carries none.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Authentication errors
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrMalformedHeader    = errors.New("malformed Authorization header, expected Bearer token")
+)
+
+type contextKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the identity
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// IdentityFromContext returns the identity stored by the middleware, or nil
+// when authentication is disabled
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(contextKey{}).(*Identity)
+	return identity
+}
+
+// NewAuthenticator builds the authenticator selected by AUTH_MODE. It
+// returns nil when authentication is disabled.
+func NewAuthenticator(cfg config.AuthConfig) (Authenticator, error) {
+	switch cfg.Mode {
+	case "", "none":
+		log.Println("Authentication disabled, trusting X-User-ID headers")
+		return nil, nil
+	case "jwt":
+		return NewJWTAuthenticator(cfg)
+	default:
+		return nil, fmt.Errorf("unknown AUTH_MODE %q", cfg.Mode)
+	}
+}
+
+// Middleware rejects requests that fail authentication and stores the
+// identity of the rest in the request context. A nil authenticator lets
+// every request through.
+func Middleware(authenticator Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if authenticator == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, err := authenticator.Authenticate(r)
+			if err != nil {
+				WriteAuthError(w, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+		})
+	}
+}
+
+// WriteAuthError answers a failed authentication with the status and
+// WWW-Authenticate challenge from RFC 6750
+func WriteAuthError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrMissingCredentials:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sse-gateway"`)
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	case ErrMalformedHeader:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sse-gateway", error="invalid_request"`)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="sse-gateway", error="invalid_token", error_description=%q`, err.Error()))
+		http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+	}
+}
+
+// bearerToken extracts the token from an Authorization: Bearer header
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", ErrMissingCredentials
+	}
+
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", ErrMalformedHeader
+	}
+	return strings.TrimSpace(token), nil
+}
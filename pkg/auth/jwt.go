@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"virtualization-manager/pkg/config"
+)
+
+// JWTAuthenticator verifies bearer JWTs signed with a shared secret or with
+// keys from a local JWKS file
+type JWTAuthenticator struct {
+	keys     []verificationKey
+	issuer   string
+	audience string
+	leeway   time.Duration
+}
+
+func NewJWTAuthenticator(cfg config.AuthConfig) (*JWTAuthenticator, error) {
+	ja := &JWTAuthenticator{
+		issuer:   cfg.JWTIssuer,
+		audience: cfg.JWTAudience,
+		leeway:   cfg.JWTLeeway,
+	}
+
+	if cfg.JWTSecret != "" {
+		ja.keys = append(ja.keys, verificationKey{key: []byte(cfg.JWTSecret)})
+	}
+
+	if cfg.JWKSFile != "" {
+		keys, err := loadJWKSFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWKS: %v", err)
+		}
+		ja.keys = append(ja.keys, keys...)
+	}
+
+	if len(ja.keys) == 0 {
+		return nil, errors.New("JWT authentication requires JWT_SECRET or JWT_JWKS_FILE")
+	}
+
+	log.Printf("JWT authentication enabled with %d keys (issuer=%q, audience=%q)", len(ja.keys), ja.issuer, ja.audience)
+	return ja, nil
+}
+
+// Authenticate verifies the bearer token on a request
+func (ja *JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	return ja.Verify(token)
+}
+
+// Verify checks a token's signature and its exp, nbf, iss and aud claims
+func (ja *JWTAuthenticator) Verify(token string) (*Identity, error) {
+	return ja.VerifyAudience(token, ja.audience)
+}
+
+// VerifyAudience is Verify for tokens issued to a different audience, such
+// as the admin API. An empty audience is not checked.
+func (ja *JWTAuthenticator) VerifyAudience(token, audience string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token must have three segments")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid signature encoding")
+	}
+
+	if err := ja.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	if err := ja.validateClaims(claims, audience); err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	return &Identity{Subject: subject, Claims: claims}, nil
+}
+
+func (ja *JWTAuthenticator) verifySignature(alg, kid, signingInput string, signature []byte) error {
+	hashFunc, err := hashForAlg(alg)
+	if err != nil {
+		return err
+	}
+
+	for _, candidate := range ja.keys {
+		if kid != "" && candidate.id != "" && candidate.id != kid {
+			continue
+		}
+		if candidate.alg != "" && candidate.alg != alg {
+			continue
+		}
+
+		if verifyWithKey(alg, hashFunc, candidate.key, signingInput, signature) {
+			return nil
+		}
+	}
+
+	return errors.New("signature verification failed")
+}
+
+func verifyWithKey(alg string, hashFunc crypto.Hash, key interface{}, signingInput string, signature []byte) bool {
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(newHash(hashFunc), secret)
+		mac.Write([]byte(signingInput))
+		return hmac.Equal(mac.Sum(nil), signature)
+
+	case "RS":
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := digest(hashFunc, signingInput)
+		return rsa.VerifyPKCS1v15(publicKey, hashFunc, digest, signature) == nil
+
+	case "ES":
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(publicKey, digest(hashFunc, signingInput), r, s)
+	}
+
+	return false
+}
+
+func (ja *JWTAuthenticator) validateClaims(claims map[string]interface{}, audience string) error {
+	now := time.Now()
+
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(exp, 0).Add(ja.leeway)) {
+		return errors.New("token has expired")
+	}
+
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(ja.leeway).Before(time.Unix(nbf, 0)) {
+		return errors.New("token is not valid yet")
+	}
+
+	if ja.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != ja.issuer {
+			return errors.New("token issuer is not trusted")
+		}
+	}
+
+	if audience != "" && !hasAudience(claims["aud"], audience) {
+		return errors.New("token audience does not match")
+	}
+
+	return nil
+}
+
+// hasAudience accepts aud as a single string or a list of strings
+func hasAudience(aud interface{}, expected string) bool {
+	switch value := aud.(type) {
+	case string:
+		return value == expected
+	case []interface{}:
+		for _, item := range value {
+			if item == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	value, ok := claims[name].(float64)
+	if !ok {
+		return 0, false
+	}
+	return int64(value), true
+}
+
+func hashForAlg(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "HS256", "RS256", "ES256":
+		return crypto.SHA256, nil
+	case "HS384", "RS384", "ES384":
+		return crypto.SHA384, nil
+	case "HS512", "RS512", "ES512":
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
+func newHash(hashFunc crypto.Hash) func() hash.Hash {
+	switch hashFunc {
+	case crypto.SHA384:
+		return sha512.New384
+	case crypto.SHA512:
+		return sha512.New
+	}
+	return sha256.New
+}
+
+func digest(hashFunc crypto.Hash, input string) []byte {
+	h := newHash(hashFunc)()
+	h.Write([]byte(input))
+	return h.Sum(nil)
+}
+
+func decodeSegment(segment string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
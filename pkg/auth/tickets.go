@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"virtualization-manager/pkg/config"
+	"virtualization-manager/pkg/redis"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Ticket errors
+var (
+	ErrInvalidTicket  = errors.New("invalid ticket")
+	ErrExpiredTicket  = errors.New("ticket has expired")
+	ErrTicketRedeemed = errors.New("ticket has already been used")
+	ErrTicketClient   = errors.New("ticket was issued for a different client")
+)
+
+// ticketClaims is the signed body of a connection ticket
+type ticketClaims struct {
+	ID        string `json:"jti"`
+	ClientID  string `json:"cid"`
+	UserID    string `json:"sub,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// TicketRequest is the body of POST /auth/ticket
+type TicketRequest struct {
+	ClientID string `json:"client_id"`
+	UserID   string `json:"user_id,omitempty"`
+}
+
+// TicketService mints short-lived, single-use tickets that let browser
+// EventSource and WebSocket clients authenticate through a query parameter
+type TicketService struct {
+	redisClient *redis.Client
+	secret      []byte
+	ttl         time.Duration
+}
+
+func NewTicketService(redisClient *redis.Client, cfg config.AuthConfig) *TicketService {
+	secret := []byte(cfg.TicketSecret)
+	if len(secret) == 0 {
+		// Tickets then only verify on the replica that issued them
+		log.Println("TICKET_SECRET not set, using a random per-process ticket secret")
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+
+	return &TicketService{
+		redisClient: redisClient,
+		secret:      secret,
+		ttl:         cfg.TicketTTL,
+	}
+}
+
+// IssueTicket mints a ticket for the caller. With authentication enabled the
+// ticket is bound to the verified subject; otherwise user_id is taken from
+// the request body.
+func (ts *TicketService) IssueTicket(w http.ResponseWriter, r *http.Request) {
+	var request TicketRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if request.ClientID == "" {
+		http.Error(w, "client_id is required", http.StatusBadRequest)
+		return
+	}
+
+	userID := request.UserID
+	if identity := IdentityFromContext(r.Context()); identity != nil {
+		userID = identity.Subject
+	}
+
+	claims := ticketClaims{
+		ID:        uuid.New().String(),
+		ClientID:  request.ClientID,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(ts.ttl).Unix(),
+	}
+
+	ticket, err := ts.sign(claims)
+	if err != nil {
+		http.Error(w, "Failed to issue ticket", http.StatusInternalServerError)
+		return
+	}
+
+	if err := ts.redisClient.StoreTicket(claims.ID, ts.ttl); err != nil {
+		log.Printf("Failed to store ticket for client %s: %v", request.ClientID, err)
+		http.Error(w, "Failed to issue ticket", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticket":     ticket,
+		"client_id":  claims.ClientID,
+		"user_id":    claims.UserID,
+		"expires_at": claims.ExpiresAt,
+	})
+}
+
+// Redeem verifies a ticket for the given client and consumes it
+func (ts *TicketService) Redeem(ticket, clientID string) (*Identity, error) {
+	body, signature, found := strings.Cut(ticket, ".")
+	if !found {
+		return nil, ErrInvalidTicket
+	}
+
+	expected := ts.mac(body)
+	provided, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, provided) {
+		return nil, ErrInvalidTicket
+	}
+
+	var claims ticketClaims
+	if err := decodeSegment(body, &claims); err != nil {
+		return nil, ErrInvalidTicket
+	}
+
+	if time.Now().Unix() > claims.ExpiresAt {
+		return nil, ErrExpiredTicket
+	}
+	if claims.ClientID != clientID {
+		return nil, ErrTicketClient
+	}
+
+	redeemed, err := ts.redisClient.RedeemTicket(claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !redeemed {
+		return nil, ErrTicketRedeemed
+	}
+
+	return &Identity{
+		Subject: claims.UserID,
+		Claims: map[string]interface{}{
+			"sub":         claims.UserID,
+			"client_id":   claims.ClientID,
+			"auth_method": "ticket",
+		},
+	}, nil
+}
+
+// Middleware authenticates requests carrying a ticket query parameter and
+// hands every other request to the regular authentication middleware
+func (ts *TicketService) Middleware(authenticator Authenticator) func(http.Handler) http.Handler {
+	fallback := Middleware(authenticator)
+
+	return func(next http.Handler) http.Handler {
+		authenticated := fallback(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ticket := r.URL.Query().Get("ticket")
+			if ticket == "" {
+				authenticated.ServeHTTP(w, r)
+				return
+			}
+
+			identity, err := ts.Redeem(ticket, mux.Vars(r)["clientId"])
+			switch err {
+			case nil:
+				next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+			case ErrTicketClient:
+				http.Error(w, err.Error(), http.StatusForbidden)
+			case ErrInvalidTicket, ErrExpiredTicket, ErrTicketRedeemed:
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			default:
+				log.Printf("Failed to redeem ticket: %v", err)
+				http.Error(w, "Failed to redeem ticket", http.StatusInternalServerError)
+			}
+		})
+	}
+}
+
+func (ts *TicketService) sign(claims ticketClaims) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	body := base64.RawURLEncoding.EncodeToString(data)
+	return body + "." + base64.RawURLEncoding.EncodeToString(ts.mac(body)), nil
+}
+
+func (ts *TicketService) mac(body string) []byte {
+	mac := hmac.New(sha256.New, ts.secret)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
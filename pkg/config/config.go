@@ -2,15 +2,31 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"time"
 )
 
 type Config struct {
-	Server ServerConfig
-	Redis  RedisConfig
+	Server       ServerConfig
+	Redis        RedisConfig
+	Replay       ReplayConfig
+	Invoke       InvokeConfig
+	Backpressure BackpressureConfig
+	Auth         AuthConfig
+	RateLimit    RateLimitConfig
+	Breaker      BreakerConfig
+	Functions    FunctionsConfig
+	Registry     RegistryConfig
 }
 
 type ServerConfig struct {
-	Port string
+	Port   string
+	NodeID string
+
+	// Graceful drain on shutdown
+	DrainTimeout     time.Duration
+	DrainRetryMin    time.Duration
+	DrainRetryJitter time.Duration
 }
 
 type RedisConfig struct {
@@ -19,16 +35,156 @@ type RedisConfig struct {
 	DB       int
 }
 
+// ReplayConfig controls the per-client log used to replay missed messages
+// to reconnecting clients.
+type ReplayConfig struct {
+	Size int
+	TTL  time.Duration
+}
+
+// InvokeConfig controls background execution of async invocations and how
+// long invocation records are kept for polling
+type InvokeConfig struct {
+	AsyncWorkers   int
+	AsyncQueueSize int
+	ResultTTL      time.Duration
+	IdempotencyTTL time.Duration
+}
+
+// BackpressureConfig sets the default slow-consumer policy for connections
+// that do not choose one
+type BackpressureConfig struct {
+	Policy       string
+	BlockTimeout time.Duration
+}
+
+// AuthConfig selects how clients and invocations are authenticated
+type AuthConfig struct {
+	Mode        string
+	JWTSecret   string
+	JWKSFile    string
+	JWTIssuer   string
+	JWTAudience string
+	JWTLeeway   time.Duration
+	RolesClaim  string
+
+	// One-time connection tickets for clients that cannot send headers
+	TicketSecret string
+	TicketTTL    time.Duration
+
+	// Admin API
+	AdminMode        string
+	AdminAPIKey      string
+	AdminRoleClaim   string
+	AdminJWTAudience string
+}
+
+// RateLimitConfig holds the default invocation rate limits, written as
+// "requests/period" (e.g. "100/1m"). Empty limits are disabled.
+type RateLimitConfig struct {
+	Global   string
+	Function string
+	Client   string
+	User     string
+}
+
+// BreakerConfig controls the per-function circuit breakers. A breaker opens
+// after FailureThreshold consecutive failures, or when at least MinRequests
+// calls in Window fail at ErrorRate or more. Zero disables either trigger.
+type BreakerConfig struct {
+	FailureThreshold int
+	ErrorRate        float64
+	MinRequests      int
+	Window           time.Duration
+	OpenTimeout      time.Duration
+	HalfOpenProbes   int
+}
+
+// FunctionsConfig points the registry at declarative function definitions
+// in a YAML or JSON file or directory
+type FunctionsConfig struct {
+	File           string
+	WatchInterval  time.Duration
+	DryRun         bool
+	ConflictPolicy string
+}
+
+// RegistryConfig controls how replicas keep their function registries in
+// sync. Changes are shared over pub/sub; the periodic resync from Redis
+// catches any that were missed.
+type RegistryConfig struct {
+	ResyncInterval time.Duration
+}
+
 func Load() *Config {
 	return &Config{
 		Server: ServerConfig{
-			Port: getEnv("PORT", "8080"),
+			Port:   getEnv("PORT", "8080"),
+			NodeID: getEnv("NODE_ID", defaultNodeID()),
+
+			DrainTimeout:     getEnvDuration("DRAIN_TIMEOUT", 30*time.Second),
+			DrainRetryMin:    getEnvDuration("DRAIN_RETRY_MIN", time.Second),
+			DrainRetryJitter: getEnvDuration("DRAIN_RETRY_JITTER", 10*time.Second),
 		},
 		Redis: RedisConfig{
 			Addr:     getEnv("REDIS_ADDR", "localhost:6379"),
 			Password: getEnv("REDIS_PASSWORD", ""),
 			DB:       0,
 		},
+		Replay: ReplayConfig{
+			Size: getEnvInt("REPLAY_BUFFER_SIZE", 500),
+			TTL:  getEnvDuration("REPLAY_TTL", time.Hour),
+		},
+		Invoke: InvokeConfig{
+			AsyncWorkers:   getEnvInt("ASYNC_WORKERS", 16),
+			AsyncQueueSize: getEnvInt("ASYNC_QUEUE_SIZE", 1000),
+			ResultTTL:      getEnvDuration("INVOCATION_RESULT_TTL", 24*time.Hour),
+			IdempotencyTTL: getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+		},
+		Backpressure: BackpressureConfig{
+			Policy:       getEnv("BACKPRESSURE_POLICY", "drop_newest"),
+			BlockTimeout: getEnvDuration("BACKPRESSURE_BLOCK_TIMEOUT", 500*time.Millisecond),
+		},
+		Auth: AuthConfig{
+			Mode:        getEnv("AUTH_MODE", "none"),
+			JWTSecret:   getEnv("JWT_SECRET", ""),
+			JWKSFile:    getEnv("JWT_JWKS_FILE", ""),
+			JWTIssuer:   getEnv("JWT_ISSUER", ""),
+			JWTAudience: getEnv("JWT_AUDIENCE", ""),
+			JWTLeeway:   getEnvDuration("JWT_LEEWAY", 30*time.Second),
+			RolesClaim:  getEnv("AUTH_ROLES_CLAIM", "roles"),
+
+			TicketSecret: getEnv("TICKET_SECRET", ""),
+			TicketTTL:    getEnvDuration("TICKET_TTL", 30*time.Second),
+
+			AdminMode:        getEnv("ADMIN_AUTH", "apikey"),
+			AdminAPIKey:      getEnv("ADMIN_API_KEY", ""),
+			AdminRoleClaim:   getEnv("ADMIN_ROLE_CLAIM", "role"),
+			AdminJWTAudience: getEnv("ADMIN_JWT_AUDIENCE", ""),
+		},
+		RateLimit: RateLimitConfig{
+			Global:   getEnv("RATE_LIMIT_GLOBAL", ""),
+			Function: getEnv("RATE_LIMIT_FUNCTION", ""),
+			Client:   getEnv("RATE_LIMIT_CLIENT", ""),
+			User:     getEnv("RATE_LIMIT_USER", ""),
+		},
+		Breaker: BreakerConfig{
+			FailureThreshold: getEnvInt("BREAKER_FAILURE_THRESHOLD", 5),
+			ErrorRate:        getEnvFloat("BREAKER_ERROR_RATE", 0.5),
+			MinRequests:      getEnvInt("BREAKER_MIN_REQUESTS", 20),
+			Window:           getEnvDuration("BREAKER_WINDOW", time.Minute),
+			OpenTimeout:      getEnvDuration("BREAKER_OPEN_TIMEOUT", 30*time.Second),
+			HalfOpenProbes:   getEnvInt("BREAKER_HALF_OPEN_PROBES", 1),
+		},
+		Functions: FunctionsConfig{
+			File:           getEnv("FUNCTIONS_FILE", ""),
+			WatchInterval:  getEnvDuration("FUNCTIONS_WATCH_INTERVAL", 10*time.Second),
+			DryRun:         getEnvBool("FUNCTIONS_DRY_RUN", false),
+			ConflictPolicy: getEnv("FUNCTIONS_CONFLICT_POLICY", "file"),
+		},
+		Registry: RegistryConfig{
+			ResyncInterval: getEnvDuration("REGISTRY_RESYNC_INTERVAL", 30*time.Second),
+		},
 	}
 }
 
@@ -38,3 +194,49 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// defaultNodeID identifies this replica on the cluster bus. The process ID
+// keeps replicas sharing a hostname apart.
+func defaultNodeID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "node"
+	}
+	return hostname + "-" + strconv.Itoa(os.Getpid())
+}
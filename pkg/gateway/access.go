@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"virtualization-manager/pkg/types"
+)
+
+// checkAccess evaluates a function's access policy against the caller. It
+// returns the reason the invocation is denied, or "" if it is allowed.
+func (sg *SSEGateway) checkAccess(function *types.Function, request *types.InvocationRequest) string {
+	policy := function.Access
+	if policy == nil {
+		return ""
+	}
+
+	// User, role and claim rules only trust a verified identity
+	authenticated := request.UserID != ""
+	needsIdentity := policy.Visibility == types.VisibilityPrivate ||
+		len(policy.Users) > 0 || len(policy.Roles) > 0 || len(policy.Claims) > 0
+	if needsIdentity && !authenticated {
+		return fmt.Sprintf("Function %s requires an authenticated caller", function.Name)
+	}
+
+	if len(policy.Users) > 0 && !containsString(policy.Users, request.UserID) {
+		return fmt.Sprintf("User %s is not allowed to invoke %s", request.UserID, function.Name)
+	}
+
+	if len(policy.Roles) > 0 && !hasAnyRole(request.Claims[sg.rolesClaim], policy.Roles) {
+		return fmt.Sprintf("Invoking %s requires one of the roles: %s", function.Name, strings.Join(policy.Roles, ", "))
+	}
+
+	for claim, want := range policy.Claims {
+		if !claimMatches(request.Claims[claim], want) {
+			return fmt.Sprintf("Claim %s does not allow invoking %s", claim, function.Name)
+		}
+	}
+
+	if len(policy.ClientIDs) > 0 && !matchesAnyPattern(policy.ClientIDs, request.ClientID) {
+		if request.ClientID == "" {
+			return fmt.Sprintf("Function %s requires a client_id", function.Name)
+		}
+		return fmt.Sprintf("Client %s is not allowed to invoke %s", request.ClientID, function.Name)
+	}
+
+	return ""
+}
+
+// hasAnyRole accepts a roles claim given as a string or a list of strings
+func hasAnyRole(claim interface{}, roles []string) bool {
+	switch value := claim.(type) {
+	case string:
+		for _, role := range strings.Fields(value) {
+			if containsString(roles, role) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			if role, ok := item.(string); ok && containsString(roles, role) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimMatches compares a claim with a policy value. List claims match when
+// any element equals the value.
+func claimMatches(claim interface{}, want string) bool {
+	switch value := claim.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, item := range value {
+			if fmt.Sprint(item) == want {
+				return true
+			}
+		}
+		return false
+	default:
+		return fmt.Sprint(value) == want
+	}
+}
+
+func matchesAnyPattern(patterns []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
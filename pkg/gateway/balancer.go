@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sync"
+
+	"virtualization-manager/pkg/types"
+)
+
+// balancer picks an endpoint for each attempt of an invocation and tracks
+// the requests in flight to every endpoint on this instance
+type balancer struct {
+	mutex    sync.Mutex
+	next     map[string]uint64
+	inFlight map[string]int64
+}
+
+func newBalancer() *balancer {
+	return &balancer{
+		next:     make(map[string]uint64),
+		inFlight: make(map[string]int64),
+	}
+}
+
+// pick chooses an endpoint with the function's strategy. Healthy endpoints
+// not yet tried by this invocation are preferred; if every endpoint is
+// unhealthy they are all used rather than failing outright. The caller must
+// call done with the returned URL once the request has finished.
+func (b *balancer) pick(function *types.Function, clientID string, tried []string) (string, error) {
+	if len(function.Endpoints) == 0 {
+		if function.Endpoint == "" {
+			return "", fmt.Errorf("function %s has no endpoint", function.Name)
+		}
+		b.acquire(function.Endpoint)
+		return function.Endpoint, nil
+	}
+
+	candidates := filterEndpoints(function.Endpoints, func(e types.Endpoint) bool {
+		return e.Healthy && !containsString(tried, e.URL)
+	})
+	if len(candidates) == 0 {
+		candidates = filterEndpoints(function.Endpoints, func(e types.Endpoint) bool { return e.Healthy })
+	}
+	if len(candidates) == 0 {
+		candidates = function.Endpoints
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var chosen types.Endpoint
+	switch function.Balancing {
+	case types.BalanceWeighted:
+		chosen = pickWeighted(candidates)
+	case types.BalanceLeastInFlight:
+		chosen = b.pickLeastInFlight(candidates)
+	case types.BalanceConsistentHash:
+		if clientID != "" {
+			chosen = pickByHash(candidates, clientID)
+			break
+		}
+		chosen = b.pickRoundRobin(function.Name, candidates)
+	default:
+		chosen = b.pickRoundRobin(function.Name, candidates)
+	}
+
+	b.inFlight[chosen.URL]++
+	return chosen.URL, nil
+}
+
+func (b *balancer) acquire(url string) {
+	b.mutex.Lock()
+	b.inFlight[url]++
+	b.mutex.Unlock()
+}
+
+// done marks a request to an endpoint as finished
+func (b *balancer) done(url string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.inFlight[url]--
+	if b.inFlight[url] <= 0 {
+		delete(b.inFlight, url)
+	}
+}
+
+// InFlight returns the requests in flight per endpoint URL
+func (b *balancer) InFlight() map[string]int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	inFlight := make(map[string]int64, len(b.inFlight))
+	for url, count := range b.inFlight {
+		inFlight[url] = count
+	}
+	return inFlight
+}
+
+func (b *balancer) pickRoundRobin(name string, candidates []types.Endpoint) types.Endpoint {
+	n := b.next[name]
+	b.next[name] = n + 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+func (b *balancer) pickLeastInFlight(candidates []types.Endpoint) types.Endpoint {
+	best := candidates[0]
+	for _, endpoint := range candidates[1:] {
+		// Compare in-flight requests relative to weight
+		if b.inFlight[endpoint.URL]*int64(best.Weight) < b.inFlight[best.URL]*int64(endpoint.Weight) {
+			best = endpoint
+		}
+	}
+	return best
+}
+
+func pickWeighted(candidates []types.Endpoint) types.Endpoint {
+	total := 0
+	for _, endpoint := range candidates {
+		total += endpointWeight(endpoint)
+	}
+
+	n := rand.Intn(total)
+	for _, endpoint := range candidates {
+		n -= endpointWeight(endpoint)
+		if n < 0 {
+			return endpoint
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// pickByHash uses weighted rendezvous hashing, so a client keeps its
+// endpoint and only the clients of an endpoint that leaves the rotation move
+func pickByHash(candidates []types.Endpoint, clientID string) types.Endpoint {
+	best := candidates[0]
+	bestScore := math.Inf(-1)
+	for _, endpoint := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(clientID))
+		h.Write([]byte{0})
+		h.Write([]byte(endpoint.URL))
+
+		// Map the hash into (0, 1) and weight it
+		unit := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		score := -float64(endpointWeight(endpoint)) / math.Log(unit)
+		if score > bestScore {
+			best = endpoint
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// mix64 spreads FNV's output over all bits (the splitmix64 finalizer), since
+// keys that differ only in their last bytes hash close together
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func endpointWeight(endpoint types.Endpoint) int {
+	if endpoint.Weight <= 0 {
+		return 1
+	}
+	return endpoint.Weight
+}
+
+func filterEndpoints(endpoints []types.Endpoint, keep func(types.Endpoint) bool) []types.Endpoint {
+	var filtered []types.Endpoint
+	for _, endpoint := range endpoints {
+		if keep(endpoint) {
+			filtered = append(filtered, endpoint)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,80 @@
+package gateway
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// StartDrain stops the gateway from accepting new connections and
+// invocations, and tells every connected client to reconnect elsewhere
+// after a jittered delay
+func (sg *SSEGateway) StartDrain() {
+	if !atomic.CompareAndSwapInt32(&sg.draining, 0, 1) {
+		return
+	}
+
+	log.Println("Draining gateway: rejecting new connections and invocations")
+	sg.connectionManager.NotifyDraining(sg.drainRetryDelay)
+}
+
+// IsDraining reports whether StartDrain has been called
+func (sg *SSEGateway) IsDraining() bool {
+	return atomic.LoadInt32(&sg.draining) == 1
+}
+
+// beginInFlight counts an invocation from the moment it is received until
+// endInFlight. It is counted before prepareInvocation checks for a drain,
+// so a drain either rejects the invocation or waits for it.
+func (sg *SSEGateway) beginInFlight() {
+	atomic.AddInt64(&sg.inFlight, 1)
+}
+
+func (sg *SSEGateway) endInFlight() {
+	atomic.AddInt64(&sg.inFlight, -1)
+}
+
+// WaitForDrain blocks until in-flight invocations, including queued async
+// jobs, and messages queued for active clients have finished, or ctx is done
+func (sg *SSEGateway) WaitForDrain(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		inFlight := atomic.LoadInt64(&sg.inFlight)
+		queued := sg.asyncPool.QueueLength()
+		pending := sg.connectionManager.PendingMessages()
+
+		if inFlight == 0 && queued == 0 && pending == 0 {
+			log.Println("Drain complete")
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Drain deadline reached with %d in-flight invocations, %d queued jobs and %d pending messages", inFlight, queued, pending)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainRetryDelay picks a reconnect delay between the minimum and the
+// minimum plus jitter, spreading reconnects across the remaining replicas
+func (sg *SSEGateway) drainRetryDelay() time.Duration {
+	delay := sg.drain.DrainRetryMin
+	if sg.drain.DrainRetryJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(sg.drain.DrainRetryJitter)))
+	}
+	return delay
+}
+
+// rejectWhileDraining answers new connection attempts during a drain
+func (sg *SSEGateway) rejectWhileDraining(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(sg.drainRetryDelay().Seconds())+1))
+	http.Error(w, "Server is draining, retry on another instance", http.StatusServiceUnavailable)
+}
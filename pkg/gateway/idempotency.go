@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"net/http"
+	"time"
+
+	"virtualization-manager/pkg/auth"
+	"virtualization-manager/pkg/invocations"
+	"virtualization-manager/pkg/types"
+
+	"github.com/google/uuid"
+)
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// idempotentClaim is an Idempotency-Key held by the current request. The
+// zero value is used for requests without a key.
+type idempotentClaim struct {
+	store       *invocations.Store
+	key         string
+	fingerprint string
+	owner       string
+}
+
+func (c idempotentClaim) complete(status int, body interface{}) {
+	if c.key != "" {
+		c.store.CompleteIdempotent(c.key, c.fingerprint, c.owner, status, body)
+	}
+}
+
+func (c idempotentClaim) release() {
+	if c.key != "" {
+		c.store.ReleaseIdempotent(c.key, c.owner)
+	}
+}
+
+// beginIdempotent claims the request's Idempotency-Key. If the key was used
+// before, it writes the stored response (or the reason the request is
+// rejected) and returns true.
+func (sg *SSEGateway) beginIdempotent(w http.ResponseWriter, r *http.Request, function *types.Function, request types.InvocationRequest) (idempotentClaim, bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return idempotentClaim{}, false
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+		return idempotentClaim{}, true
+	}
+
+	// Keys are scoped to the function and the verified caller
+	scope := request.FunctionName + ":"
+	if identity := auth.IdentityFromContext(r.Context()); identity != nil {
+		scope += identity.Subject
+	}
+	claim := idempotentClaim{
+		store:       sg.invocationStore,
+		key:         scope + ":" + key,
+		fingerprint: invocations.IdempotencyFingerprint(request),
+		owner:       uuid.New().String(),
+	}
+
+	stored, err := sg.invocationStore.BeginIdempotent(r.Context(), claim.key, claim.fingerprint, claim.owner, idempotencyLockTTL(function, request))
+	switch {
+	case err == invocations.ErrIdempotencyMismatch:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return idempotentClaim{}, true
+	case err == invocations.ErrIdempotencyInProgress:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return idempotentClaim{}, true
+	case err != nil:
+		if r.Context().Err() == nil {
+			http.Error(w, "Failed to check Idempotency-Key", http.StatusInternalServerError)
+		}
+		return idempotentClaim{}, true
+	case stored != nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+		return idempotentClaim{}, true
+	}
+
+	return claim, false
+}
+
+// idempotencyLockTTL bounds how long a claimed key stays pending, so a
+// replica that dies mid-request does not block the key for the whole
+// idempotency window
+func idempotencyLockTTL(function *types.Function, request types.InvocationRequest) time.Duration {
+	timeout := time.Duration(function.Timeout)
+	if request.Timeout > 0 {
+		timeout = time.Duration(request.Timeout) * time.Second
+	}
+
+	attempts := 1
+	if function.Retry != nil && function.Retry.MaxAttempts > 1 {
+		attempts = function.Retry.MaxAttempts
+		deadline := time.Duration(function.Retry.Deadline)
+		if deadline > 0 && deadline < timeout*time.Duration(attempts) {
+			return deadline + 30*time.Second
+		}
+	}
+
+	return timeout*time.Duration(attempts) + 30*time.Second
+}
@@ -0,0 +1,183 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"virtualization-manager/pkg/types"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultPollTimeout = 25 * time.Second
+	maxPollTimeout     = 55 * time.Second
+	maxPollBatch       = 100
+)
+
+// HandleLongPoll serves clients that cannot keep a streaming response open.
+// The first poll registers a long_poll connection and returns the connected
+// event; later polls pass back connection_id and cursor and receive every
+// message since, waiting up to timeout seconds when nothing is pending.
+// Idle polling connections are removed by the regular stale-connection
+// cleanup.
+func (sg *SSEGateway) HandleLongPoll(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientId"]
+	if clientID == "" {
+		http.Error(w, "Client ID is required", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	timeout := defaultPollTimeout
+	if value := query.Get("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			http.Error(w, "timeout must be a non-negative number of seconds", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+
+	cursor := query.Get("cursor")
+	connection := sg.connectionManager.GetConnection(query.Get("connection_id"))
+	if connection == nil || connection.ClientID != clientID || connection.Transport != types.TransportLongPoll {
+		// Unknown, expired or held by another node: start a new session.
+		// Queued messages would otherwise be lost while no poll is
+		// waiting, so polling connections keep the newest ones by default.
+		if sg.IsDraining() {
+			sg.rejectWhileDraining(w)
+			return
+		}
+		if query.Get("backpressure") == "" {
+			query.Set("backpressure", string(types.BackpressureDropOldest))
+			r.URL.RawQuery = query.Encode()
+		}
+
+		var err error
+		connection, err = sg.openConnection(r, clientID, types.TransportLongPoll)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if cursor == "" {
+			welcome := sg.welcomeMessage(connection, "")
+			writePollResponse(w, connection, welcome.ID, []types.SSEMessage{welcome})
+			return
+		}
+	}
+
+	// Only the connection's owner may resume it and read its queue
+	if !ownsConnection(r, connection.ClientID, connection.UserID, clientID) {
+		http.Error(w, "Connection belongs to another client", http.StatusForbidden)
+		return
+	}
+
+	sg.connectionManager.UpdateLastPing(connection.ID)
+
+	// Messages logged for the client since the cursor come from the replay
+	// log; topic and broadcast messages only exist on the connection queue.
+	// Queued messages up to skipThrough were already handed out. After a gap
+	// the cursor no longer matches the log, so only what was replayed now
+	// is skipped and the gap event's ID becomes the new cursor.
+	var messages []types.SSEMessage
+	var after, skipThrough int64
+	if cursor != "" {
+		replayedUpTo, gap := sg.replayMissedMessages(func(message types.SSEMessage) {
+			messages = append(messages, message)
+		}, connection, cursor)
+		skipThrough = replayedUpTo
+		if !gap {
+			after, _ = strconv.ParseInt(cursor, 10, 64)
+			if after > skipThrough {
+				skipThrough = after
+			}
+		}
+	}
+
+	if len(messages) > maxPollBatch {
+		// The rest of the replay follows on the next polls; the queue is
+		// left alone so the cursor does not move past it. A gap event
+		// carries the end of the log as its ID, which would skip the rest.
+		messages = messages[:maxPollBatch]
+		if messages[0].Event == "gap" {
+			messages[0].ID = ""
+		}
+	} else {
+		messages = append(messages, sg.drainQueue(connection, skipThrough, maxPollBatch-len(messages))...)
+		after = skipThrough
+	}
+
+	if len(messages) == 0 && timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+	wait:
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-connection.Done:
+				break wait
+			case <-timer.C:
+				break wait
+			case message := <-connection.Channel:
+				if message.Event == "heartbeat" || alreadyReplayed(message, skipThrough) {
+					continue
+				}
+				messages = append(messages, message)
+				messages = append(messages, sg.drainQueue(connection, skipThrough, maxPollBatch-1)...)
+				break wait
+			}
+		}
+	}
+
+	// The next cursor is the highest client message ID handed out
+	nextCursor := after
+	for _, message := range messages {
+		if id, err := strconv.ParseInt(message.ID, 10, 64); err == nil && id > nextCursor {
+			nextCursor = id
+		}
+	}
+
+	sg.connectionManager.UpdateLastPing(connection.ID)
+	writePollResponse(w, connection, strconv.FormatInt(nextCursor, 10), messages)
+}
+
+// drainQueue returns up to limit messages already waiting on the connection
+// without blocking, skipping heartbeats and anything covered by the replay
+func (sg *SSEGateway) drainQueue(connection *types.Connection, replayedUpTo int64, limit int) []types.SSEMessage {
+	var messages []types.SSEMessage
+	for len(messages) < limit {
+		select {
+		case message := <-connection.Channel:
+			if message.Event == "heartbeat" || alreadyReplayed(message, replayedUpTo) {
+				continue
+			}
+			messages = append(messages, message)
+		default:
+			return messages
+		}
+	}
+	return messages
+}
+
+func writePollResponse(w http.ResponseWriter, connection *types.Connection, cursor string, messages []types.SSEMessage) {
+	if messages == nil {
+		messages = []types.SSEMessage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(types.PollResponse{
+		ConnectionID: connection.ID,
+		Cursor:       cursor,
+		Messages:     messages,
+	})
+}
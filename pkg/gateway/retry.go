@@ -0,0 +1,157 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"virtualization-manager/pkg/types"
+)
+
+// sendWithRetries sends the request built by newRequest and retries the
+// failures the function's retry policy marks as retryable. Only the last
+// response is returned; the bodies of earlier ones are discarded. Failures
+// are only retried before the response body is read, so chunks already
+// relayed from a streaming function are never repeated.
+func (sg *SSEGateway) sendWithRetries(function *types.Function, timeout time.Duration, newRequest func() (*http.Request, error)) (*http.Response, int, error) {
+	policy := function.Retry
+	maxAttempts := 1
+	var deadline time.Time
+	if policy != nil && (policy.NonIdempotent || isIdempotent(function.Method)) {
+		if policy.MaxAttempts > 1 {
+			maxAttempts = policy.MaxAttempts
+		}
+		if policy.Deadline > 0 {
+			deadline = time.Now().Add(time.Duration(policy.Deadline))
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		httpReq, err := newRequest()
+		if err != nil {
+			return nil, attempt, err
+		}
+
+		// Never let an attempt run past the total deadline. A client
+		// timeout of zero would mean no timeout at all.
+		attemptTimeout := timeout
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				if attempt > 1 {
+					atomic.AddInt64(&sg.retriedInvocations, 1)
+					atomic.AddInt64(&sg.retriesExhausted, 1)
+				}
+				return nil, attempt - 1, fmt.Errorf("retry deadline of %v exceeded", time.Duration(policy.Deadline))
+			}
+			if remaining < attemptTimeout {
+				attemptTimeout = remaining
+			}
+		}
+
+		client := &http.Client{
+			Timeout: attemptTimeout,
+		}
+		resp, err := client.Do(httpReq)
+
+		retryable := isRetryable(policy, resp, err)
+		delay := retryBackoff(policy, attempt)
+		outOfTime := !deadline.IsZero() && !time.Now().Add(delay).Before(deadline)
+
+		if !retryable || attempt >= maxAttempts || outOfTime {
+			if attempt > 1 {
+				atomic.AddInt64(&sg.retriedInvocations, 1)
+				if retryable {
+					atomic.AddInt64(&sg.retriesExhausted, 1)
+				}
+			}
+			return resp, attempt, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		log.Printf("Attempt %d/%d for function %s failed (%s), retrying in %v", attempt, maxAttempts, function.Name, reason, delay)
+
+		atomic.AddInt64(&sg.retryAttempts, 1)
+		time.Sleep(delay)
+	}
+}
+
+// isIdempotent reports whether calling a function with method twice has
+// the same effect as calling it once
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// isRetryable reports whether a failed attempt may be retried under policy
+func isRetryable(policy *types.RetryPolicy, resp *http.Response, err error) bool {
+	if policy == nil {
+		return false
+	}
+
+	if err == nil {
+		for _, status := range policy.RetryableStatuses {
+			if resp.StatusCode == status {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, kind := range policy.RetryableErrors {
+		if errorIsKind(err, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func errorIsKind(err error, kind string) bool {
+	switch kind {
+	case types.RetryOnConnectionRefused:
+		return errors.Is(err, syscall.ECONNREFUSED)
+	case types.RetryOnConnectionReset:
+		return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+	case types.RetryOnEOF:
+		return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	case types.RetryOnTimeout:
+		var netErr net.Error
+		return errors.As(err, &netErr) && netErr.Timeout()
+	}
+	return false
+}
+
+// retryBackoff returns the delay before the attempt after the given one:
+// exponential growth capped at MaxBackoff, with the upper half jittered so
+// that callers retrying together spread out
+func retryBackoff(policy *types.RetryPolicy, attempt int) time.Duration {
+	if policy == nil || policy.InitialBackoff <= 0 {
+		return 0
+	}
+
+	backoff := float64(policy.InitialBackoff) * math.Pow(policy.Multiplier, float64(attempt-1))
+	if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+
+	half := backoff / 2
+	return time.Duration(half + rand.Float64()*half)
+}
@@ -2,15 +2,24 @@ package gateway
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"virtualization-manager/pkg/auth"
+	"virtualization-manager/pkg/config"
+	"virtualization-manager/pkg/invocations"
 	"virtualization-manager/pkg/manager"
+	"virtualization-manager/pkg/ratelimit"
 	"virtualization-manager/pkg/registry"
 	"virtualization-manager/pkg/types"
 
@@ -21,14 +30,36 @@ import (
 type SSEGateway struct {
 	connectionManager *manager.ConnectionManager
 	functionRegistry  *registry.FunctionRegistry
+	invocationStore   *invocations.Store
+	rateLimiter       *ratelimit.Limiter
+	balancer          *balancer
+	versionStats      *versionStats
+	asyncPool         *workerPool
 	startTime         time.Time
+	rolesClaim        string
+
+	drain    config.ServerConfig
+	draining int32
+	inFlight int64
+
+	// Retry metrics
+	retriedInvocations int64
+	retryAttempts      int64
+	retriesExhausted   int64
 }
 
-func NewSSEGateway(connectionManager *manager.ConnectionManager, functionRegistry *registry.FunctionRegistry) *SSEGateway {
+func NewSSEGateway(connectionManager *manager.ConnectionManager, functionRegistry *registry.FunctionRegistry, invocationStore *invocations.Store, rateLimiter *ratelimit.Limiter, cfg *config.Config) *SSEGateway {
 	return &SSEGateway{
 		connectionManager: connectionManager,
 		functionRegistry:  functionRegistry,
+		invocationStore:   invocationStore,
+		rateLimiter:       rateLimiter,
+		balancer:          newBalancer(),
+		versionStats:      newVersionStats(),
+		asyncPool:         newWorkerPool(cfg.Invoke.AsyncWorkers, cfg.Invoke.AsyncQueueSize),
 		startTime:         time.Now(),
+		rolesClaim:        cfg.Auth.RolesClaim,
+		drain:             cfg.Server,
 	}
 }
 
@@ -49,33 +80,30 @@ func (sg *SSEGateway) HandleSSEConnection(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Extract metadata from query parameters
-	metadata := make(map[string]string)
-	for key, values := range r.URL.Query() {
-		if len(values) > 0 {
-			metadata[key] = values[0]
-		}
+	if sg.IsDraining() {
+		sg.rejectWhileDraining(w)
+		return
 	}
 
-	userID := r.Header.Get("X-User-ID")
-
-	// Create new connection
-	connection := sg.connectionManager.AddConnection(clientID, userID, metadata)
+	connection, err := sg.openConnection(r, clientID, types.TransportSSE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	defer sg.connectionManager.RemoveConnection(connection.ID)
 
-	// Send welcome message
-	welcomeMsg := types.SSEMessage{
-		ID:    uuid.New().String(),
-		Event: "connected",
-		Data: map[string]interface{}{
-			"connection_id": connection.ID,
-			"client_id":     clientID,
-			"timestamp":     time.Now().Unix(),
-			"message":       "Connected to SSE Virtualization Manager",
-		},
-	}
+	// Send welcome message, then replay messages missed while the client
+	// was disconnected. Live messages are already queued on the
+	// connection, so anything covered by the replay is skipped below.
+	lastEventID := r.Header.Get("Last-Event-ID")
+	sg.writeSSEMessage(w, sg.welcomeMessage(connection, lastEventID))
 
-	sg.writeSSEMessage(w, welcomeMsg)
+	var replayedUpTo int64
+	if lastEventID != "" {
+		replayedUpTo, _ = sg.replayMissedMessages(func(message types.SSEMessage) {
+			sg.writeSSEMessage(w, message)
+		}, connection, lastEventID)
+	}
 
 	// Listen for client disconnect
 	notify := w.(http.CloseNotifier).CloseNotify()
@@ -88,10 +116,13 @@ func (sg *SSEGateway) HandleSSEConnection(w http.ResponseWriter, r *http.Request
 			log.Printf("Client %s disconnected", clientID)
 			return
 
-		case message, ok := <-connection.Channel:
-			if !ok {
-				// Channel closed
-				return
+		case <-connection.Done:
+			// Connection removed by the manager
+			return
+
+		case message := <-connection.Channel:
+			if alreadyReplayed(message, replayedUpTo) {
+				continue
 			}
 
 			// Send message to client
@@ -111,6 +142,124 @@ func (sg *SSEGateway) HandleSSEConnection(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// openConnection registers a connection for any transport, applying the
+// topic, filter and backpressure options from the query string. Query
+// parameters are also kept as connection metadata.
+func (sg *SSEGateway) openConnection(r *http.Request, clientID, transport string) (*types.Connection, error) {
+	query := r.URL.Query()
+
+	filter, err := manager.ParseEventFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	backpressure, err := manager.ParseBackpressurePolicy(query.Get("backpressure"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Extract metadata from query parameters, leaving out credentials
+	metadata := make(map[string]string)
+	for key, values := range query {
+		if len(values) > 0 && key != "ticket" {
+			metadata[key] = values[0]
+		}
+	}
+
+	// With authentication enabled the verified subject replaces the
+	// self-reported header
+	userID := r.Header.Get("X-User-ID")
+	if identity := auth.IdentityFromContext(r.Context()); identity != nil {
+		userID = identity.Subject
+	}
+
+	// Create new connection
+	connection := sg.connectionManager.AddConnection(clientID, userID, transport, metadata, manager.ConnectionOptions{
+		Filter:       filter,
+		Backpressure: backpressure,
+	})
+
+	if topics := manager.ParseTopics(query.Get("topics")); len(topics) > 0 {
+		sg.connectionManager.Subscribe(connection.ID, topics)
+	}
+
+	return connection, nil
+}
+
+// welcomeMessage builds the connected event. A fresh connection gets the
+// current replay cursor as its ID so a later reconnect resumes from this
+// point; a resuming connection keeps the last event ID it sent.
+func (sg *SSEGateway) welcomeMessage(connection *types.Connection, lastEventID string) types.SSEMessage {
+	welcomeMsg := types.SSEMessage{
+		Event: "connected",
+		Data: map[string]interface{}{
+			"connection_id": connection.ID,
+			"client_id":     connection.ClientID,
+			"transport":     connection.Transport,
+			"topics":        sg.connectionManager.GetConnectionTopics(connection.ID),
+			"timestamp":     time.Now().Unix(),
+			"message":       "Connected to SSE Virtualization Manager",
+		},
+	}
+	if lastEventID == "" {
+		welcomeMsg.ID = sg.connectionManager.GetReplayCursor(connection.ClientID)
+	}
+
+	return welcomeMsg
+}
+
+// replayMissedMessages writes every logged message after lastEventID to the
+// client, preceded by a gap event if part of that range is no longer
+// available. The gap event carries the current replay cursor, so the client
+// resumes from there rather than from the lost range. Messages the
+// connection's filter rejects are skipped. It returns the highest event ID
+// replayed and whether there was a gap.
+func (sg *SSEGateway) replayMissedMessages(write func(types.SSEMessage), connection *types.Connection, lastEventID string) (int64, bool) {
+	clientID := connection.ClientID
+	messages, gap, err := sg.connectionManager.ReplaySince(clientID, lastEventID)
+	if err != nil && err != manager.ErrInvalidEventID {
+		log.Printf("Failed to replay messages for client %s: %v", clientID, err)
+		return 0, false
+	}
+
+	gap = gap || err == manager.ErrInvalidEventID
+	if gap {
+		write(types.SSEMessage{
+			ID:    sg.connectionManager.GetReplayCursor(clientID),
+			Event: "gap",
+			Data: map[string]interface{}{
+				"last_event_id": lastEventID,
+				"timestamp":     time.Now().Unix(),
+				"message":       "Some messages since the last received event are no longer available",
+			},
+		})
+	}
+
+	var replayedUpTo int64
+	for _, message := range messages {
+		if manager.MatchesFilter(connection.Filter, message) {
+			write(message)
+		}
+		if id, err := strconv.ParseInt(message.ID, 10, 64); err == nil && id > replayedUpTo {
+			replayedUpTo = id
+		}
+	}
+
+	if len(messages) > 0 {
+		log.Printf("Replayed %d messages to client %s after event %s", len(messages), clientID, lastEventID)
+	}
+	return replayedUpTo, gap
+}
+
+// alreadyReplayed reports whether a live message was covered by a replay
+func alreadyReplayed(message types.SSEMessage, replayedUpTo int64) bool {
+	if replayedUpTo == 0 {
+		return false
+	}
+	id, err := strconv.ParseInt(message.ID, 10, 64)
+	return err == nil && id <= replayedUpTo
+}
+
 // InvokeFunction handles function invocation requests
 func (sg *SSEGateway) InvokeFunction(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -123,25 +272,291 @@ func (sg *SSEGateway) InvokeFunction(w http.ResponseWriter, r *http.Request) {
 	}
 
 	request.FunctionName = functionName
+	setInvocationIdentity(&request, auth.IdentityFromContext(r.Context()))
 
-	// Get function details
-	function, err := sg.functionRegistry.GetFunction(functionName)
+	sg.beginInFlight()
+	defer sg.endInFlight()
+
+	function, err := sg.resolveInvocation(&request)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Function not found: %s", functionName), http.StatusNotFound)
+		writeInvocationError(w, err)
 		return
 	}
 
-	if !function.IsActive {
-		http.Error(w, fmt.Sprintf("Function %s is not active", functionName), http.StatusServiceUnavailable)
+	// Repeated requests with the same Idempotency-Key get the first result.
+	// This is checked before rate limits and the circuit breaker, so
+	// duplicates do not use up tokens or probes.
+	idempotency, replayed := sg.beginIdempotent(w, r, function, request)
+	if replayed {
 		return
 	}
 
+	function, decision, err := sg.admitInvocation(function, &request)
+	if err != nil {
+		idempotency.release()
+		writeInvocationError(w, err)
+		return
+	}
+	if decision.Limit > 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		w.Header().Set("X-RateLimit-Scope", decision.Scope)
+	}
+
 	// Generate request ID
 	requestID := uuid.New().String()
+
+	if request.Async {
+		if err := sg.submitAsyncInvocation(function, request, requestID); err != nil {
+			idempotency.release()
+			writeInvocationError(w, err)
+			return
+		}
+
+		message := "Function invoked, poll /invocations/" + requestID + " for the result"
+		if request.ClientID != "" {
+			message = "Function invoked, response will be sent via SSE"
+		}
+
+		accepted := types.AsyncInvocationResponse{
+			Success:   true,
+			RequestID: requestID,
+			Message:   message,
+			ClientID:  request.ClientID,
+		}
+		idempotency.complete(http.StatusAccepted, accepted)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(accepted)
+		return
+	}
+
+	record := sg.invocationStore.Begin(requestID, request, types.InvocationRunning)
+
+	// Streaming functions relay their output to the caller as it arrives
+	if function.Streaming {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		response := sg.executeInvocation(function, request, record, func(message types.SSEMessage) {
+			sg.writeSSEMessage(w, message)
+		})
+		idempotency.complete(http.StatusOK, response)
+		return
+	}
+
+	response := sg.executeInvocation(function, request, record, nil)
+	idempotency.complete(http.StatusOK, response)
+
+	// Always return HTTP response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// invocationError is a rejected invocation with the HTTP status to report
+type invocationError struct {
+	status  int
+	message string
+}
+
+func (e *invocationError) Error() string {
+	return e.message
+}
+
+// rateLimitedError is an invocation rejected by a rate limit
+type rateLimitedError struct {
+	invocationError
+	decision ratelimit.Decision
+}
+
+// circuitOpenError is an invocation rejected because the function's
+// circuit breaker is open
+type circuitOpenError struct {
+	invocationError
+	retryAfter time.Duration
+}
+
+// writeInvocationError reports a rejected invocation to an HTTP caller
+func writeInvocationError(w http.ResponseWriter, err error) {
+	if open, ok := err.(*circuitOpenError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(ratelimit.RetryAfterSeconds(open.retryAfter)))
+		http.Error(w, open.message, open.status)
+		return
+	}
+	if limited, ok := err.(*rateLimitedError); ok {
+		retryAfter := strconv.Itoa(ratelimit.RetryAfterSeconds(limited.decision.RetryAfter))
+		w.Header().Set("Retry-After", retryAfter)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limited.decision.Limit))
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", retryAfter)
+		w.Header().Set("X-RateLimit-Scope", limited.decision.Scope)
+		http.Error(w, limited.message, limited.status)
+		return
+	}
+	if invErr, ok := err.(*invocationError); ok {
+		http.Error(w, invErr.message, invErr.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// setInvocationIdentity attaches the verified caller to a request so it is
+// recorded and forwarded to the function
+func setInvocationIdentity(request *types.InvocationRequest, identity *auth.Identity) {
+	if identity == nil {
+		return
+	}
+	request.UserID = identity.Subject
+	request.Claims = identity.Claims
+}
+
+// prepareInvocation resolves the target function and checks that the
+// request may be executed. It is shared by every transport that accepts
+// invocations.
+func (sg *SSEGateway) prepareInvocation(request *types.InvocationRequest) (*types.Function, error) {
+	function, err := sg.resolveInvocation(request)
+	if err != nil {
+		return nil, err
+	}
+	function, _, err = sg.admitInvocation(function, request)
+	return function, err
+}
+
+// resolveInvocation looks up the target function and checks that the caller
+// may invoke it. It has no side effects, so requests that end up not running
+// can be turned away after it without using up anything.
+func (sg *SSEGateway) resolveInvocation(request *types.InvocationRequest) (*types.Function, error) {
+	if sg.IsDraining() {
+		return nil, &invocationError{http.StatusServiceUnavailable, "Server is draining, retry on another instance"}
+	}
+
+	// "name@alias" or "name@revision" pins a revision
+	name, _ := registry.SplitFunctionRef(request.FunctionName)
+
+	// Get function details
+	function, err := sg.functionRegistry.GetFunction(name)
+	if err != nil {
+		return nil, &invocationError{http.StatusNotFound, fmt.Sprintf("Function not found: %s", request.FunctionName)}
+	}
+
+	if function.Disabled {
+		return nil, &invocationError{http.StatusServiceUnavailable, fmt.Sprintf("Function %s is disabled", name)}
+	}
+
+	if !function.IsActive {
+		return nil, &invocationError{http.StatusServiceUnavailable, fmt.Sprintf("Function %s is not active", request.FunctionName)}
+	}
+
+	if reason := sg.checkAccess(function, request); reason != "" {
+		return nil, &invocationError{http.StatusForbidden, reason}
+	}
+
+	return function, nil
+}
+
+// admitInvocation takes a rate limit token, picks the version or revision
+// that serves the request and checks its circuit breaker. It also returns
+// the rate limit decision so HTTP callers can report the remaining tokens.
+func (sg *SSEGateway) admitInvocation(function *types.Function, request *types.InvocationRequest) (*types.Function, ratelimit.Decision, error) {
+	_, ref := registry.SplitFunctionRef(request.FunctionName)
+
+	decision := sg.rateLimiter.Allow(function, request.ClientID, request.UserID)
+	if !decision.Allowed {
+		return nil, decision, &rateLimitedError{
+			invocationError{http.StatusTooManyRequests, fmt.Sprintf("Rate limit exceeded for %s (%s limit)", request.FunctionName, decision.Scope)},
+			decision,
+		}
+	}
+
+	selected := function
+	if ref != "" {
+		var err error
+		selected, err = sg.functionRegistry.ResolveRef(function, ref)
+		if err != nil {
+			return nil, decision, &invocationError{http.StatusNotFound, err.Error()}
+		}
+	} else {
+		// Route to a version according to the function's traffic split
+		selected = sg.functionRegistry.SelectVersion(function, request.ClientID)
+	}
+
+	// Each version has its own circuit, so a failing version does not stop
+	// traffic to the others
+	if allowed, retryAfter := sg.functionRegistry.AllowInvocation(selected.Name, selected.Version); !allowed {
+		return nil, decision, &circuitOpenError{
+			invocationError{http.StatusServiceUnavailable, fmt.Sprintf("Circuit open for function %s, failing fast", request.FunctionName)},
+			retryAfter,
+		}
+	}
+
+	return selected, decision, nil
+}
+
+// submitAsyncInvocation records an invocation as queued and hands it to the
+// worker pool
+func (sg *SSEGateway) submitAsyncInvocation(function *types.Function, request types.InvocationRequest, requestID string) error {
+	record := sg.invocationStore.Begin(requestID, request, types.InvocationQueued)
+
+	// Queued jobs count as in flight until a worker has finished them
+	sg.beginInFlight()
+	accepted := sg.asyncPool.Submit(func() {
+		defer sg.endInFlight()
+		sg.executeInvocation(function, request, record, nil)
+	})
+	if !accepted {
+		sg.endInFlight()
+		sg.invocationStore.Complete(record, types.InvocationFailed, &types.InvocationResponse{
+			Success:   false,
+			Error:     "async invocation queue is full",
+			RequestID: requestID,
+		})
+		return &invocationError{http.StatusServiceUnavailable, "Async invocation queue is full"}
+	}
+
+	return nil
+}
+
+// executeInvocation calls the function, records the outcome and, if a client
+// ID is provided, delivers the result to the client's SSE connections. For
+// streaming functions every chunk is delivered as a function_chunk event;
+// chunks are not kept in the replay log, only the final function_response
+// is. stream, if set, additionally receives every event sent for this
+// invocation.
+func (sg *SSEGateway) executeInvocation(function *types.Function, request types.InvocationRequest, record *types.InvocationRecord, stream func(types.SSEMessage)) *types.InvocationResponse {
+	requestID := record.RequestID
+	if record.Status != types.InvocationRunning {
+		sg.invocationStore.SetStatus(record, types.InvocationRunning)
+	}
+
+	deliver := func(message types.SSEMessage, logged bool) {
+		if request.ClientID != "" {
+			if logged {
+				sg.connectionManager.BroadcastToClient(request.ClientID, message)
+			} else {
+				sg.connectionManager.SendToClient(request.ClientID, message)
+			}
+		}
+		if stream != nil {
+			stream(message)
+		}
+	}
+
+	var emit chunkEmitter
+	if function.Streaming {
+		emit = func(chunk types.FunctionChunk) {
+			deliver(types.SSEMessage{
+				Event: "function_chunk",
+				Data:  chunk,
+			}, false)
+		}
+	}
+
 	startTime := time.Now()
 
 	// Prepare function invocation
-	response, err := sg.invokeFunctionEndpoint(function, request, requestID)
+	response, attempts, err := sg.invokeFunctionEndpoint(function, request, requestID, emit)
 	duration := time.Since(startTime).Milliseconds()
 
 	if err != nil {
@@ -155,68 +570,106 @@ func (sg *SSEGateway) InvokeFunction(w http.ResponseWriter, r *http.Request) {
 		response.Duration = duration
 		response.RequestID = requestID
 	}
+	response.Attempts = attempts
+	response.Version = function.Version
+	response.Revision = function.Revision
+	sg.versionStats.record(function, response)
+
+	sg.functionRegistry.RecordInvocation(function.Name, function.Version, upstreamHealthy(response, err))
+	sg.invocationStore.Complete(record, invocationStatus(response, err), response)
+
+	// Send the result to the client's SSE connections and the stream
+	deliver(types.SSEMessage{
+		ID:    requestID,
+		Event: "function_response",
+		Data:  response,
+	}, true)
+
+	return response
+}
 
-	// If client ID is provided, send result via SSE
-	if request.ClientID != "" {
-		message := types.SSEMessage{
-			ID:    requestID,
-			Event: "function_response",
-			Data:  response,
-		}
-
-		sg.connectionManager.BroadcastToClient(request.ClientID, message)
+// invocationStatus maps the outcome of an upstream call to a final status
+func invocationStatus(response *types.InvocationResponse, err error) types.InvocationStatus {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return types.InvocationTimedOut
 	}
+	if err != nil || !response.Success {
+		return types.InvocationFailed
+	}
+	return types.InvocationSucceeded
+}
 
-	// Always return HTTP response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// upstreamHealthy reports whether an outcome counts as a success for the
+// circuit breaker. Client errors are the caller's fault and do not count.
+func upstreamHealthy(response *types.InvocationResponse, err error) bool {
+	return err == nil && response.StatusCode < 500
 }
 
-// invokeFunctionEndpoint invokes the actual serverless function
-func (sg *SSEGateway) invokeFunctionEndpoint(function *types.Function, request types.InvocationRequest, requestID string) (*types.InvocationResponse, error) {
+// invokeFunctionEndpoint invokes the actual serverless function, retrying
+// as the function's retry policy allows. When emit is set the response body
+// is relayed through it incrementally instead of being buffered. It also
+// returns the number of attempts made.
+func (sg *SSEGateway) invokeFunctionEndpoint(function *types.Function, request types.InvocationRequest, requestID string, emit chunkEmitter) (*types.InvocationResponse, int, error) {
 	// Prepare payload
 	payload, err := json.Marshal(request.Payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal payload: %v", err)
-	}
-
-	// Create HTTP request
-	httpReq, err := http.NewRequest(function.Method, function.Endpoint, bytes.NewBuffer(payload))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	// Set headers
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("X-Request-ID", requestID)
-	httpReq.Header.Set("X-Client-ID", request.ClientID)
-
-	// Add custom function headers
-	for key, value := range function.Headers {
-		httpReq.Header.Set(key, value)
+		return nil, 0, fmt.Errorf("failed to marshal payload: %v", err)
 	}
 
 	// Configure HTTP client with timeout
-	timeout := function.Timeout
+	timeout := time.Duration(function.Timeout)
 	if request.Timeout > 0 {
 		timeout = time.Duration(request.Timeout) * time.Second
 	}
 
-	client := &http.Client{
-		Timeout: timeout,
+	// Each attempt goes to an endpoint chosen by the function's load
+	// balancing strategy, preferring ones not tried yet
+	var tried []string
+	current := ""
+	release := func() {
+		if current != "" {
+			sg.balancer.done(current)
+			current = ""
+		}
 	}
+	defer release()
 
 	// Make the request
-	resp, err := client.Do(httpReq)
+	resp, attempts, err := sg.sendWithRetries(function, timeout, func() (*http.Request, error) {
+		release()
+		endpoint, err := sg.balancer.pick(function, request.ClientID, tried)
+		if err != nil {
+			return nil, err
+		}
+		current = endpoint
+		tried = append(tried, endpoint)
+		return newFunctionRequest(function, endpoint, request, requestID, payload)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("function invocation failed: %v", err)
+		return nil, attempts, fmt.Errorf("function invocation failed: %w", err)
 	}
 	defer resp.Body.Close()
 
+	success := resp.StatusCode >= 200 && resp.StatusCode < 300
+
+	if emit != nil {
+		responseData, err := readStreamingResponse(resp, requestID, emit)
+		if err != nil {
+			return nil, attempts, fmt.Errorf("failed to read streamed response: %w", err)
+		}
+
+		return &types.InvocationResponse{
+			Success:    success,
+			Data:       responseData,
+			StatusCode: resp.StatusCode,
+		}, attempts, nil
+	}
+
 	// Read response
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %v", err)
+		return nil, attempts, fmt.Errorf("failed to read response: %v", err)
 	}
 
 	// Handle different content types
@@ -232,12 +685,45 @@ func (sg *SSEGateway) invokeFunctionEndpoint(function *types.Function, request t
 		responseData = string(responseBody)
 	}
 
-	success := resp.StatusCode >= 200 && resp.StatusCode < 300
-
 	return &types.InvocationResponse{
-		Success: success,
-		Data:    responseData,
-	}, nil
+		Success:    success,
+		Data:       responseData,
+		StatusCode: resp.StatusCode,
+	}, attempts, nil
+}
+
+// newFunctionRequest builds one HTTP request to one of the function's
+// endpoints
+func newFunctionRequest(function *types.Function, endpoint string, request types.InvocationRequest, requestID string, payload []byte) (*http.Request, error) {
+	// Create HTTP request
+	httpReq, err := http.NewRequest(function.Method, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	// Set headers
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Request-ID", requestID)
+	httpReq.Header.Set("X-Client-ID", request.ClientID)
+
+	// Add custom function headers
+	for key, value := range function.Headers {
+		httpReq.Header.Set(key, value)
+	}
+
+	// Forward the verified caller last so function headers cannot spoof it
+	if request.UserID != "" {
+		httpReq.Header.Set("X-User-ID", request.UserID)
+	}
+	if len(request.Claims) > 0 {
+		claims, err := json.Marshal(request.Claims)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal claims: %v", err)
+		}
+		httpReq.Header.Set("X-Auth-Claims", base64.RawURLEncoding.EncodeToString(claims))
+	}
+
+	return httpReq, nil
 }
 
 // writeSSEMessage writes an SSE message to the response writer
@@ -273,7 +759,7 @@ func (sg *SSEGateway) writeSSEMessage(w http.ResponseWriter, message types.SSEMe
 
 // GetConnections returns information about active connections
 func (sg *SSEGateway) GetConnections(w http.ResponseWriter, r *http.Request) {
-	connections := sg.connectionManager.GetAllConnections()
+	connections := sg.connectionManager.GetConnectionSnapshots()
 	stats := sg.connectionManager.GetStats()
 
 	response := map[string]interface{}{
@@ -297,10 +783,23 @@ func (sg *SSEGateway) HealthCheck(w http.ResponseWriter, r *http.Request) {
 		RegisteredFunctions: functionStats["total_functions"].(int),
 		RedisConnected:      true, // TODO: Implement actual Redis health check
 		Uptime:              time.Since(sg.startTime),
-		Metrics: map[string]interface{}{
-			"connections": connectionStats,
-			"functions":   functionStats,
-		},
+	}
+
+	// Health stays reachable for probes; detailed metrics need a viewer key
+	if auth.HasRole(r.Context(), auth.RoleViewer) {
+		health.Metrics = map[string]interface{}{
+			"connections":         connectionStats,
+			"functions":           functionStats,
+			"async_queue_length":  sg.asyncPool.QueueLength(),
+			"rate_limits":         sg.rateLimiter.GetStats(),
+			"endpoints_in_flight": sg.balancer.InFlight(),
+			"versions":            sg.versionStats.snapshot(),
+			"retries": map[string]int64{
+				"retried_invocations": atomic.LoadInt64(&sg.retriedInvocations),
+				"retry_attempts":      atomic.LoadInt64(&sg.retryAttempts),
+				"retries_exhausted":   atomic.LoadInt64(&sg.retriesExhausted),
+			},
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
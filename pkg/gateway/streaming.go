@@ -0,0 +1,150 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"virtualization-manager/pkg/types"
+)
+
+// chunkEmitter receives each piece of streamed function output
+type chunkEmitter func(chunk types.FunctionChunk)
+
+// readStreamingResponse relays the upstream body chunk by chunk as it
+// arrives. Upstream text/event-stream responses are relayed one event per
+// chunk; any other body is relayed as raw text. It returns the aggregated
+// output for the final function_response.
+func readStreamingResponse(resp *http.Response, requestID string, emit chunkEmitter) (interface{}, error) {
+	if strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return relayUpstreamEvents(resp.Body, requestID, emit)
+	}
+	return relayRawChunks(resp.Body, requestID, emit)
+}
+
+// relayUpstreamEvents parses an upstream SSE stream and emits each event.
+// The aggregated result is the list of event payloads.
+func relayUpstreamEvents(body io.Reader, requestID string, emit chunkEmitter) (interface{}, error) {
+	reader := bufio.NewReader(body)
+	events := make([]interface{}, 0)
+
+	var eventName string
+	var dataLines []string
+
+	dispatch := func() {
+		if len(dataLines) == 0 {
+			eventName = ""
+			return
+		}
+
+		data := decodeChunkData(strings.Join(dataLines, "\n"))
+		emit(types.FunctionChunk{
+			RequestID: requestID,
+			Sequence:  len(events),
+			Event:     eventName,
+			Data:      data,
+		})
+		events = append(events, data)
+
+		eventName = ""
+		dataLines = nil
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			line = strings.TrimRight(line, "\r\n")
+
+			switch {
+			case line == "":
+				dispatch()
+			case strings.HasPrefix(line, ":"):
+				// Comment line, used upstream as a keep-alive
+			default:
+				field, value, _ := strings.Cut(line, ":")
+				value = strings.TrimPrefix(value, " ")
+
+				switch field {
+				case "event":
+					eventName = value
+				case "data":
+					dataLines = append(dataLines, value)
+				}
+			}
+		}
+
+		if err == io.EOF {
+			dispatch()
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+	}
+}
+
+// relayRawChunks emits the body as text in the pieces it arrives in, never
+// splitting a UTF-8 sequence. The aggregated result is the whole body.
+func relayRawChunks(body io.Reader, requestID string, emit chunkEmitter) (interface{}, error) {
+	var output strings.Builder
+	var pending []byte
+	buf := make([]byte, 4096)
+	sequence := 0
+
+	flush := func(data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		emit(types.FunctionChunk{
+			RequestID: requestID,
+			Sequence:  sequence,
+			Data:      string(data),
+		})
+		output.Write(data)
+		sequence++
+	}
+
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			pending = append(pending, buf[:n]...)
+			complete := completeUTF8Prefix(pending)
+			flush(pending[:complete])
+			pending = append([]byte(nil), pending[complete:]...)
+		}
+
+		if err == io.EOF {
+			flush(pending)
+			return output.String(), nil
+		}
+		if err != nil {
+			return output.String(), err
+		}
+	}
+}
+
+// completeUTF8Prefix returns the length of data without a trailing
+// incomplete UTF-8 sequence
+func completeUTF8Prefix(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if utf8.FullRune(data[i:]) {
+				return len(data)
+			}
+			return i
+		}
+	}
+	return len(data)
+}
+
+// decodeChunkData returns JSON event payloads decoded, anything else as text
+func decodeChunkData(data string) interface{} {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(data), &decoded); err == nil {
+		return decoded
+	}
+	return data
+}
@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"virtualization-manager/pkg/auth"
+	"virtualization-manager/pkg/manager"
+	"virtualization-manager/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// PublishToTopic delivers a message to every subscriber of a topic
+func (sg *SSEGateway) PublishToTopic(w http.ResponseWriter, r *http.Request) {
+	topic := mux.Vars(r)["topic"]
+	if err := manager.ValidateTopic(topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request types.PublishRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	event := request.Event
+	if event == "" {
+		event = "topic_message"
+	}
+
+	// Topic messages are not in any client's replay log, so they carry no
+	// event ID: a client resuming with Last-Event-ID must send back an ID
+	// from its replay log
+	messageID := uuid.New().String()
+	message := types.SSEMessage{
+		Event: event,
+		Data: map[string]interface{}{
+			"topic":      topic,
+			"message_id": messageID,
+			"data":       request.Data,
+			"timestamp":  time.Now().Unix(),
+		},
+	}
+
+	sg.connectionManager.PublishToTopic(topic, message)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"topic":      topic,
+		"message_id": messageID,
+	})
+}
+
+// SubscribeTopics adds topics to an existing connection
+func (sg *SSEGateway) SubscribeTopics(w http.ResponseWriter, r *http.Request) {
+	connectionID := mux.Vars(r)["connectionId"]
+
+	var request types.TopicSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if len(request.Topics) == 0 {
+		http.Error(w, "At least one topic is required", http.StatusBadRequest)
+		return
+	}
+	for _, topic := range request.Topics {
+		if err := manager.ValidateTopic(topic); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !sg.authorizeConnection(w, r, connectionID) {
+		return
+	}
+
+	local, err := sg.connectionManager.Subscribe(connectionID, request.Topics)
+	sg.writeSubscriptionResult(w, connectionID, request.Topics, local, err)
+}
+
+// UnsubscribeTopic removes a topic from an existing connection
+func (sg *SSEGateway) UnsubscribeTopic(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	connectionID := vars["connectionId"]
+	topics := []string{vars["topic"]}
+
+	if !sg.authorizeConnection(w, r, connectionID) {
+		return
+	}
+
+	local, err := sg.connectionManager.Unsubscribe(connectionID, topics)
+	sg.writeSubscriptionResult(w, connectionID, topics, local, err)
+}
+
+// authorizeConnection checks that the caller owns a connection before its
+// subscriptions are changed. An authenticated caller must be the
+// connection's user or carry its client_id claim; without authentication
+// the X-Client-ID header must name the connection's client.
+func (sg *SSEGateway) authorizeConnection(w http.ResponseWriter, r *http.Request, connectionID string) bool {
+	clientID, userID, err := sg.connectionManager.GetConnectionOwner(connectionID)
+	if err != nil {
+		http.Error(w, "Connection not found: "+connectionID, http.StatusNotFound)
+		return false
+	}
+
+	if !ownsConnection(r, clientID, userID, r.Header.Get("X-Client-ID")) {
+		http.Error(w, "Connection belongs to another client", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// ownsConnection reports whether the caller owns the connection of the
+// given client and user. Without authentication the caller names its client
+// in claimedClient.
+func ownsConnection(r *http.Request, clientID, userID, claimedClient string) bool {
+	if identity := auth.IdentityFromContext(r.Context()); identity != nil {
+		claimed, _ := identity.Claims["client_id"].(string)
+		return (userID != "" && identity.Subject == userID) || claimed == clientID
+	}
+	return claimedClient == clientID
+}
+
+// writeSubscriptionResult reports a subscription change. Changes for
+// connections held by another node are applied asynchronously, so they are
+// answered with 202 Accepted.
+func (sg *SSEGateway) writeSubscriptionResult(w http.ResponseWriter, connectionID string, topics []string, local bool, err error) {
+	if err == manager.ErrConnectionNotFound {
+		http.Error(w, "Connection not found: "+connectionID, http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":       true,
+		"connection_id": connectionID,
+		"topics":        topics,
+	}
+	if local {
+		if topics := sg.connectionManager.GetConnectionTopics(connectionID); topics != nil {
+			response["subscribed_topics"] = topics
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !local {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"sync"
+
+	"virtualization-manager/pkg/types"
+)
+
+// versionStats counts invocations, failures and latency per function
+// version on this instance, so a canary can be compared with its baseline
+type versionStats struct {
+	mutex    sync.Mutex
+	counters map[string]map[string]*versionCounters
+}
+
+type versionCounters struct {
+	invocations    uint64
+	errors         uint64
+	totalLatencyMs int64
+	maxLatencyMs   int64
+}
+
+func newVersionStats() *versionStats {
+	return &versionStats{
+		counters: make(map[string]map[string]*versionCounters),
+	}
+}
+
+func (vs *versionStats) record(function *types.Function, response *types.InvocationResponse) {
+	version := function.Version
+	if version == "" {
+		version = types.DefaultVersion
+	}
+
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+
+	versions, exists := vs.counters[function.Name]
+	if !exists {
+		versions = make(map[string]*versionCounters)
+		vs.counters[function.Name] = versions
+	}
+	counters, exists := versions[version]
+	if !exists {
+		counters = &versionCounters{}
+		versions[version] = counters
+	}
+
+	counters.invocations++
+	if !response.Success {
+		counters.errors++
+	}
+	counters.totalLatencyMs += response.Duration
+	if response.Duration > counters.maxLatencyMs {
+		counters.maxLatencyMs = response.Duration
+	}
+}
+
+// snapshot returns the counters by function and version
+func (vs *versionStats) snapshot() map[string]map[string]interface{} {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+
+	snapshot := make(map[string]map[string]interface{}, len(vs.counters))
+	for name, versions := range vs.counters {
+		byVersion := make(map[string]interface{}, len(versions))
+		for version, counters := range versions {
+			byVersion[version] = map[string]interface{}{
+				"invocations":    counters.invocations,
+				"errors":         counters.errors,
+				"error_rate":     float64(counters.errors) / float64(counters.invocations),
+				"avg_latency_ms": counters.totalLatencyMs / int64(counters.invocations),
+				"max_latency_ms": counters.maxLatencyMs,
+			}
+		}
+		snapshot[name] = byVersion
+	}
+	return snapshot
+}
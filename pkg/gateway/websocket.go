@@ -0,0 +1,235 @@
+package gateway
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"virtualization-manager/pkg/auth"
+	"virtualization-manager/pkg/manager"
+	"virtualization-manager/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsMaxFrameSize = 64 * 1024
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// CORS is open for every other endpoint, so accept any origin here too
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// HandleWebSocketConnection serves the same message stream as
+// HandleSSEConnection over a WebSocket, encoding each SSEMessage as a JSON
+// frame. Clients can also send invoke, subscribe and unsubscribe frames.
+func (sg *SSEGateway) HandleWebSocketConnection(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientId"]
+	if clientID == "" {
+		http.Error(w, "Client ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if sg.IsDraining() {
+		sg.rejectWhileDraining(w)
+		return
+	}
+
+	// Validate options before upgrading so errors get a proper status code
+	if _, err := manager.ParseEventFilter(r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := manager.ParseBackpressurePolicy(r.URL.Query().Get("backpressure")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already written an error response
+		log.Printf("WebSocket upgrade failed for client %s: %v", clientID, err)
+		return
+	}
+	defer ws.Close()
+
+	connection, err := sg.openConnection(r, clientID, types.TransportWebSocket)
+	if err != nil {
+		ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+		return
+	}
+	defer sg.connectionManager.RemoveConnection(connection.ID)
+
+	// Browsers cannot set headers on WebSocket requests, so the resume
+	// point is passed as a query parameter
+	lastEventID := r.URL.Query().Get("last_event_id")
+	if err := writeWebSocketMessage(ws, sg.welcomeMessage(connection, lastEventID)); err != nil {
+		return
+	}
+
+	var replayedUpTo int64
+	if lastEventID != "" {
+		replayedUpTo, _ = sg.replayMissedMessages(func(message types.SSEMessage) {
+			writeWebSocketMessage(ws, message)
+		}, connection, lastEventID)
+	}
+
+	closed := make(chan struct{})
+	go sg.readWebSocketFrames(ws, connection, auth.IdentityFromContext(r.Context()), closed)
+
+	// Message processing loop, mirroring the SSE transport
+	for {
+		select {
+		case <-closed:
+			log.Printf("WebSocket client %s disconnected", clientID)
+			return
+
+		case <-connection.Done:
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(wsWriteTimeout))
+			return
+
+		case message := <-connection.Channel:
+			if alreadyReplayed(message, replayedUpTo) {
+				continue
+			}
+
+			if err := writeWebSocketMessage(ws, message); err != nil {
+				log.Printf("Failed to write to WebSocket client %s: %v", clientID, err)
+				return
+			}
+
+			sg.connectionManager.UpdateLastPing(connection.ID)
+
+		case <-time.After(30 * time.Second):
+			heartbeat := types.SSEMessage{
+				Event: "heartbeat",
+				Data:  map[string]interface{}{"timestamp": time.Now().Unix()},
+			}
+			if err := writeWebSocketMessage(ws, heartbeat); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readWebSocketFrames handles frames sent by the client until the socket
+// fails, then closes the closed channel. Replies are queued on the
+// connection so that only the main loop writes to the socket.
+func (sg *SSEGateway) readWebSocketFrames(ws *websocket.Conn, connection *types.Connection, identity *auth.Identity, closed chan struct{}) {
+	defer close(closed)
+
+	ws.SetReadLimit(wsMaxFrameSize)
+
+	for {
+		var frame types.WebSocketFrame
+		if err := ws.ReadJSON(&frame); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("WebSocket read error for connection %s: %v", connection.ID, err)
+			}
+			return
+		}
+
+		sg.connectionManager.UpdateLastPing(connection.ID)
+
+		switch frame.Type {
+		case "invoke":
+			sg.handleWebSocketInvoke(connection, identity, frame)
+		case "subscribe", "unsubscribe":
+			sg.handleWebSocketSubscription(connection, frame)
+		case "ping":
+			sg.replyToFrame(connection, frame, "pong", nil)
+		default:
+			sg.replyWithError(connection, frame, "unknown frame type: "+frame.Type)
+		}
+	}
+}
+
+// handleWebSocketInvoke runs an invocation in the background. The result is
+// delivered to all of the client's connections as a function_response event.
+func (sg *SSEGateway) handleWebSocketInvoke(connection *types.Connection, identity *auth.Identity, frame types.WebSocketFrame) {
+	request := types.InvocationRequest{
+		FunctionName: frame.Function,
+		Payload:      frame.Payload,
+		ClientID:     connection.ClientID,
+		Async:        true,
+		Timeout:      frame.Timeout,
+	}
+	setInvocationIdentity(&request, identity)
+
+	sg.beginInFlight()
+	defer sg.endInFlight()
+
+	function, err := sg.prepareInvocation(&request)
+	if err != nil {
+		sg.replyWithError(connection, frame, err.Error())
+		return
+	}
+
+	requestID := uuid.New().String()
+	if err := sg.submitAsyncInvocation(function, request, requestID); err != nil {
+		sg.replyWithError(connection, frame, err.Error())
+		return
+	}
+
+	sg.replyToFrame(connection, frame, "invocation_accepted", map[string]interface{}{
+		"request_id": requestID,
+		"function":   frame.Function,
+	})
+}
+
+func (sg *SSEGateway) handleWebSocketSubscription(connection *types.Connection, frame types.WebSocketFrame) {
+	if len(frame.Topics) == 0 {
+		sg.replyWithError(connection, frame, "at least one topic is required")
+		return
+	}
+	for _, topic := range frame.Topics {
+		if err := manager.ValidateTopic(topic); err != nil {
+			sg.replyWithError(connection, frame, err.Error())
+			return
+		}
+	}
+
+	if frame.Type == "subscribe" {
+		sg.connectionManager.Subscribe(connection.ID, frame.Topics)
+	} else {
+		sg.connectionManager.Unsubscribe(connection.ID, frame.Topics)
+	}
+
+	sg.replyToFrame(connection, frame, frame.Type+"d", map[string]interface{}{
+		"topics": sg.connectionManager.GetConnectionTopics(connection.ID),
+	})
+}
+
+// replyToFrame queues a reply event for the connection that sent a frame
+func (sg *SSEGateway) replyToFrame(connection *types.Connection, frame types.WebSocketFrame, event string, data map[string]interface{}) {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	if frame.Ref != "" {
+		data["ref"] = frame.Ref
+	}
+	data["timestamp"] = time.Now().Unix()
+
+	if err := sg.connectionManager.SendToConnection(connection.ID, types.SSEMessage{Event: event, Data: data}); err != nil {
+		log.Printf("Failed to reply to WebSocket connection %s: %v", connection.ID, err)
+	}
+}
+
+func (sg *SSEGateway) replyWithError(connection *types.Connection, frame types.WebSocketFrame, message string) {
+	sg.replyToFrame(connection, frame, "error", map[string]interface{}{
+		"error": message,
+		"type":  frame.Type,
+	})
+}
+
+// writeWebSocketMessage writes an SSEMessage as a JSON text frame
+func writeWebSocketMessage(ws *websocket.Conn, message types.SSEMessage) error {
+	ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return ws.WriteJSON(message)
+}
@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"log"
+)
+
+// workerPool runs jobs on a fixed number of goroutines fed by a bounded queue
+type workerPool struct {
+	jobs chan func()
+}
+
+func newWorkerPool(workers, queueSize int) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	pool := &workerPool{
+		jobs: make(chan func(), queueSize),
+	}
+
+	for i := 0; i < workers; i++ {
+		go pool.worker()
+	}
+
+	log.Printf("Started async worker pool with %d workers and queue size %d", workers, queueSize)
+	return pool
+}
+
+// Submit queues a job without blocking. It returns false when the queue is full.
+func (p *workerPool) Submit(job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// QueueLength returns the number of jobs waiting for a worker
+func (p *workerPool) QueueLength() int {
+	return len(p.jobs)
+}
+
+func (p *workerPool) worker() {
+	for job := range p.jobs {
+		p.run(job)
+	}
+}
+
+func (p *workerPool) run(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Async job panicked: %v", r)
+		}
+	}()
+
+	job()
+}
@@ -0,0 +1,140 @@
+package invocations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"virtualization-manager/pkg/types"
+
+	goredis "github.com/go-redis/redis/v8"
+)
+
+var (
+	ErrIdempotencyMismatch   = errors.New("Idempotency-Key was already used for a different request")
+	ErrIdempotencyInProgress = errors.New("a request with this Idempotency-Key is still in progress")
+)
+
+// idempotencyPollInterval is how often a duplicate checks whether the
+// original request has finished
+const idempotencyPollInterval = 100 * time.Millisecond
+
+// IdempotentResult is the response stored for an Idempotency-Key. Until the
+// original request finishes it only holds the request fingerprint and the
+// owner of the claim.
+type IdempotentResult struct {
+	Fingerprint string          `json:"fingerprint"`
+	Owner       string          `json:"owner,omitempty"`
+	Completed   bool            `json:"completed"`
+	Status      int             `json:"status,omitempty"`
+	Body        json.RawMessage `json:"body,omitempty"`
+}
+
+// IdempotencyFingerprint hashes the parts of a request that must match for a
+// repeated Idempotency-Key to be accepted
+func IdempotencyFingerprint(request types.InvocationRequest) string {
+	data, _ := json.Marshal(struct {
+		Function string                 `json:"function"`
+		Payload  map[string]interface{} `json:"payload"`
+		ClientID string                 `json:"client_id"`
+		Async    bool                   `json:"async"`
+		Timeout  int                    `json:"timeout"`
+	}{request.FunctionName, request.Payload, request.ClientID, request.Async, request.Timeout})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// BeginIdempotent claims an Idempotency-Key for owner, a value unique to the
+// request. It returns nil if the caller now owns the key and must run the
+// request and then call CompleteIdempotent or ReleaseIdempotent. If the key
+// was already used for the same request it returns the stored result,
+// waiting up to lockTTL for a request that is still running.
+func (s *Store) BeginIdempotent(ctx context.Context, key, fingerprint, owner string, lockTTL time.Duration) (*IdempotentResult, error) {
+	pending, err := json.Marshal(IdempotentResult{Fingerprint: fingerprint, Owner: owner})
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(lockTTL)
+	for {
+		claimed, err := s.redisClient.ClaimIdempotencyKey(key, pending, lockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			return nil, nil
+		}
+
+		data, err := s.redisClient.GetIdempotencyKey(key)
+		if err == goredis.Nil {
+			// Released or expired in between, try to claim it again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var stored IdempotentResult
+		if err := json.Unmarshal([]byte(data), &stored); err != nil {
+			return nil, err
+		}
+		if stored.Fingerprint != fingerprint {
+			return nil, ErrIdempotencyMismatch
+		}
+		if stored.Completed {
+			return &stored, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrIdempotencyInProgress
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+}
+
+// CompleteIdempotent stores the response sent for an Idempotency-Key so
+// repeated requests get it back
+func (s *Store) CompleteIdempotent(key, fingerprint, owner string, status int, body interface{}) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Failed to encode idempotent response for %s: %v", key, err)
+		s.ReleaseIdempotent(key, owner)
+		return
+	}
+
+	data, err := json.Marshal(IdempotentResult{
+		Fingerprint: fingerprint,
+		Completed:   true,
+		Status:      status,
+		Body:        encoded,
+	})
+	if err != nil {
+		log.Printf("Failed to encode idempotent response for %s: %v", key, err)
+		s.ReleaseIdempotent(key, owner)
+		return
+	}
+
+	if err := s.redisClient.StoreIdempotencyKey(key, data, s.idempotencyTTL); err != nil {
+		log.Printf("Failed to store idempotent response for %s: %v", key, err)
+	}
+}
+
+// ReleaseIdempotent gives up a claimed key without storing a response, so
+// the request can be retried. The key is only deleted while owner still
+// holds the claim; once the claim has expired it may belong to another
+// request.
+func (s *Store) ReleaseIdempotent(key, owner string) {
+	if _, err := s.redisClient.ReleaseIdempotencyKey(key, owner); err != nil {
+		log.Printf("Failed to release idempotency key %s: %v", key, err)
+	}
+}
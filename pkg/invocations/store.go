@@ -0,0 +1,92 @@
+package invocations
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"virtualization-manager/pkg/auth"
+	"virtualization-manager/pkg/config"
+	"virtualization-manager/pkg/redis"
+	"virtualization-manager/pkg/types"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Store persists the lifecycle of each invocation in Redis
+type Store struct {
+	redisClient    *redis.Client
+	ttl            time.Duration
+	idempotencyTTL time.Duration
+}
+
+func NewStore(redisClient *redis.Client, cfg *config.Config) *Store {
+	return &Store{
+		redisClient:    redisClient,
+		ttl:            cfg.Invoke.ResultTTL,
+		idempotencyTTL: cfg.Invoke.IdempotencyTTL,
+	}
+}
+
+// Begin records a new invocation in the given initial status
+func (s *Store) Begin(requestID string, request types.InvocationRequest, status types.InvocationStatus) *types.InvocationRecord {
+	now := time.Now()
+	record := &types.InvocationRecord{
+		RequestID:    requestID,
+		FunctionName: request.FunctionName,
+		ClientID:     request.ClientID,
+		UserID:       request.UserID,
+		Async:        request.Async,
+		Status:       status,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+
+	s.save(record)
+	return record
+}
+
+// SetStatus moves an invocation to a new status
+func (s *Store) SetStatus(record *types.InvocationRecord, status types.InvocationStatus) {
+	record.Status = status
+	record.UpdatedAt = time.Now()
+	s.save(record)
+}
+
+// Complete stores the final status and response of an invocation
+func (s *Store) Complete(record *types.InvocationRecord, status types.InvocationStatus, response *types.InvocationResponse) {
+	record.Response = response
+	s.SetStatus(record, status)
+}
+
+func (s *Store) save(record *types.InvocationRecord) {
+	if err := s.redisClient.StoreInvocation(record, s.ttl); err != nil {
+		log.Printf("Failed to store invocation %s: %v", record.RequestID, err)
+	}
+}
+
+// GetInvocation returns the stored record for a request ID
+func (s *Store) GetInvocation(w http.ResponseWriter, r *http.Request) {
+	requestID := mux.Vars(r)["requestId"]
+
+	record, err := s.redisClient.GetInvocation(requestID)
+	if err == goredis.Nil {
+		http.Error(w, "Invocation not found: "+requestID, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load invocation", http.StatusInternalServerError)
+		return
+	}
+
+	// Authenticated callers only see their own invocations
+	if identity := auth.IdentityFromContext(r.Context()); identity != nil && record.UserID != "" && record.UserID != identity.Subject {
+		http.Error(w, "Invocation not found: "+requestID, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
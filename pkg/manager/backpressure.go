@@ -0,0 +1,205 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"virtualization-manager/pkg/types"
+)
+
+// ParseBackpressurePolicy validates a policy name. An empty name selects
+// the server default.
+func ParseBackpressurePolicy(value string) (types.BackpressurePolicy, error) {
+	switch policy := types.BackpressurePolicy(value); policy {
+	case "", types.BackpressureDropNewest, types.BackpressureDropOldest, types.BackpressureBlock, types.BackpressureDisconnect:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid backpressure policy %q, expected one of drop_newest, drop_oldest, block, disconnect", value)
+}
+
+// blockedQueue holds the messages of a block-policy connection that are
+// waiting for room in its buffer. They are written by a goroutine of their
+// own, so a slow consumer never holds up delivery to other connections.
+type blockedQueue struct {
+	messages []blockedMessage
+}
+
+// blockedMessage is dropped if there is no room for it by deadline
+type blockedMessage struct {
+	message  types.SSEMessage
+	deadline time.Time
+}
+
+// blockedQueues tracks the blocked queues of local connections
+type blockedQueues struct {
+	mutex  sync.Mutex
+	queues map[string]*blockedQueue
+}
+
+// enqueue places a message on the connection's buffer, applying the
+// connection's backpressure policy when the buffer is full
+func (cm *ConnectionManager) enqueue(connection *types.Connection, message types.SSEMessage) error {
+	switch connection.Backpressure {
+	case types.BackpressureDropOldest:
+		// The overflow notice waits for a free slot rather than evicting
+		// another message itself
+		cm.enqueueDroppingOldest(connection, message)
+		cm.flushOverflow(connection)
+		return nil
+
+	case types.BackpressureBlock:
+		cm.flushOverflow(connection)
+		return cm.enqueueBlocking(connection, message)
+	}
+
+	cm.flushOverflow(connection)
+
+	select {
+	case connection.Channel <- message:
+		return nil
+	default:
+	}
+
+	switch connection.Backpressure {
+	case types.BackpressureDisconnect:
+		cm.recordDrop(connection)
+		atomic.AddUint64(&cm.slowDisconnects, 1)
+		log.Printf("Connection %s channel is full, disconnecting slow consumer", connection.ID)
+		cm.RemoveConnection(connection.ID)
+		return ErrSlowConsumer
+
+	default:
+		cm.recordDrop(connection)
+		log.Printf("Connection %s channel is full, dropping message", connection.ID)
+		return ErrChannelFull
+	}
+}
+
+// enqueueBlocking places a message on the buffer if there is room and
+// nothing is waiting ahead of it. Otherwise the message joins the
+// connection's blocked queue and gets BlockTimeout to find room.
+func (cm *ConnectionManager) enqueueBlocking(connection *types.Connection, message types.SSEMessage) error {
+	cm.blocked.mutex.Lock()
+	defer cm.blocked.mutex.Unlock()
+
+	queue := cm.blocked.queues[connection.ID]
+	if queue == nil {
+		select {
+		case connection.Channel <- message:
+			return nil
+		default:
+		}
+
+		queue = &blockedQueue{}
+		cm.blocked.queues[connection.ID] = queue
+		go cm.writeBlocked(connection, queue)
+	}
+
+	if len(queue.messages) >= cap(connection.Channel) {
+		cm.recordDrop(connection)
+		log.Printf("Connection %s blocked queue is full, dropping message", connection.ID)
+		return ErrChannelFull
+	}
+
+	queue.messages = append(queue.messages, blockedMessage{
+		message:  message,
+		deadline: time.Now().Add(cm.backpressure.BlockTimeout),
+	})
+	return nil
+}
+
+// writeBlocked moves a connection's blocked messages to its buffer in
+// order, until the queue is empty or the connection is removed
+func (cm *ConnectionManager) writeBlocked(connection *types.Connection, queue *blockedQueue) {
+	for {
+		cm.blocked.mutex.Lock()
+		if len(queue.messages) == 0 {
+			delete(cm.blocked.queues, connection.ID)
+			cm.blocked.mutex.Unlock()
+			return
+		}
+		next := queue.messages[0]
+		queue.messages = queue.messages[1:]
+		cm.blocked.mutex.Unlock()
+
+		timer := time.NewTimer(time.Until(next.deadline))
+		select {
+		case connection.Channel <- next.message:
+		case <-connection.Done:
+			timer.Stop()
+			cm.blocked.mutex.Lock()
+			delete(cm.blocked.queues, connection.ID)
+			cm.blocked.mutex.Unlock()
+			return
+		case <-timer.C:
+			cm.recordDrop(connection)
+			log.Printf("Connection %s did not drain within %v, dropping message", connection.ID, cm.backpressure.BlockTimeout)
+		}
+		timer.Stop()
+	}
+}
+
+// blockedMessages returns the number of messages waiting in a connection's
+// blocked queue
+func (cm *ConnectionManager) blockedMessages(connectionID string) int {
+	cm.blocked.mutex.Lock()
+	defer cm.blocked.mutex.Unlock()
+
+	if queue := cm.blocked.queues[connectionID]; queue != nil {
+		return len(queue.messages)
+	}
+	return 0
+}
+
+// enqueueDroppingOldest discards queued messages until the new one fits
+func (cm *ConnectionManager) enqueueDroppingOldest(connection *types.Connection, message types.SSEMessage) {
+	for {
+		select {
+		case connection.Channel <- message:
+			return
+		default:
+		}
+
+		select {
+		case <-connection.Channel:
+			cm.recordDrop(connection)
+		default:
+		}
+	}
+}
+
+// flushOverflow tells the client how many messages were dropped since the
+// last notice, if there is room in its buffer
+func (cm *ConnectionManager) flushOverflow(connection *types.Connection) {
+	pending := atomic.SwapUint64(&connection.PendingOverflow, 0)
+	if pending == 0 {
+		return
+	}
+
+	select {
+	case connection.Channel <- overflowMessage(connection, pending):
+	default:
+		atomic.AddUint64(&connection.PendingOverflow, pending)
+	}
+}
+
+func (cm *ConnectionManager) recordDrop(connection *types.Connection) {
+	atomic.AddUint64(&connection.DroppedMessages, 1)
+	atomic.AddUint64(&connection.PendingOverflow, 1)
+	atomic.AddUint64(&cm.droppedMessages, 1)
+}
+
+func overflowMessage(connection *types.Connection, dropped uint64) types.SSEMessage {
+	return types.SSEMessage{
+		Event: "overflow",
+		Data: map[string]interface{}{
+			"dropped":       dropped,
+			"total_dropped": atomic.LoadUint64(&connection.DroppedMessages),
+			"policy":        connection.Backpressure,
+			"timestamp":     time.Now().Unix(),
+		},
+	}
+}
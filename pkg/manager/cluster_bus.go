@@ -0,0 +1,93 @@
+package manager
+
+import (
+	"encoding/json"
+	"log"
+
+	"virtualization-manager/pkg/types"
+)
+
+const clusterChannel = "cluster:messages"
+
+// Delivery scopes carried on the cluster bus
+const (
+	scopeClient = "client"
+	scopeUser   = "user"
+	scopeAll    = "all"
+	scopeTopic  = "topic"
+
+	// Subscription changes for connections held by another node
+	scopeSubscribe   = "subscribe"
+	scopeUnsubscribe = "unsubscribe"
+)
+
+// clusterEnvelope wraps a message published to the other replicas
+type clusterEnvelope struct {
+	Origin  string           `json:"origin"`
+	Scope   string           `json:"scope"`
+	Target  string           `json:"target,omitempty"`
+	Topics  []string         `json:"topics,omitempty"`
+	Message types.SSEMessage `json:"message"`
+}
+
+// publishToCluster hands a message to every other node. The publishing node
+// has already delivered to its own connections.
+func (cm *ConnectionManager) publishToCluster(scope, target string, message types.SSEMessage) {
+	envelope := clusterEnvelope{
+		Origin:  cm.nodeID,
+		Scope:   scope,
+		Target:  target,
+		Message: message,
+	}
+
+	if err := cm.redisClient.PublishMessage(clusterChannel, envelope); err != nil {
+		log.Printf("Failed to publish %s message to cluster: %v", scope, err)
+	}
+}
+
+// publishSubscription asks the node holding a connection to change its topics
+func (cm *ConnectionManager) publishSubscription(scope, connectionID string, topics []string) {
+	envelope := clusterEnvelope{
+		Origin: cm.nodeID,
+		Scope:  scope,
+		Target: connectionID,
+		Topics: topics,
+	}
+
+	if err := cm.redisClient.PublishMessage(clusterChannel, envelope); err != nil {
+		log.Printf("Failed to publish %s request to cluster: %v", scope, err)
+	}
+}
+
+// startClusterSubscriber delivers messages published by other nodes to the
+// matching local connections
+func (cm *ConnectionManager) startClusterSubscriber() {
+	for msg := range cm.pubsub.Channel() {
+		var envelope clusterEnvelope
+		if err := json.Unmarshal([]byte(msg.Payload), &envelope); err != nil {
+			log.Printf("Failed to decode cluster message: %v", err)
+			continue
+		}
+
+		if envelope.Origin == cm.nodeID {
+			continue
+		}
+
+		switch envelope.Scope {
+		case scopeClient:
+			cm.deliverToClient(envelope.Target, envelope.Message)
+		case scopeUser:
+			cm.deliverToUser(envelope.Target, envelope.Message)
+		case scopeAll:
+			cm.deliverToAll(envelope.Message)
+		case scopeTopic:
+			cm.deliverToTopic(envelope.Target, envelope.Message)
+		case scopeSubscribe:
+			cm.subscribeLocal(envelope.Target, envelope.Topics)
+		case scopeUnsubscribe:
+			cm.unsubscribeLocal(envelope.Target, envelope.Topics)
+		default:
+			log.Printf("Ignoring cluster message with unknown scope %q", envelope.Scope)
+		}
+	}
+}
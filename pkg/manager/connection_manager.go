@@ -3,64 +3,113 @@ package manager
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"virtualization-manager/pkg/config"
 	"virtualization-manager/pkg/redis"
 	"virtualization-manager/pkg/types"
 
+	goredis "github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 )
 
 type ConnectionManager struct {
 	redisClient *redis.Client
 	connections map[string]*types.Connection
+	topics      map[string]map[string]struct{} // topic -> connection IDs
 	mutex       sync.RWMutex
 	startTime   time.Time
+	nodeID      string
+	replay      config.ReplayConfig
+	pubsub      *goredis.PubSub
+
+	backpressure    config.BackpressureConfig
+	blocked         blockedQueues
+	droppedMessages uint64
+	slowDisconnects uint64
+
+	draining int32
 }
 
-func NewConnectionManager(redisClient *redis.Client) *ConnectionManager {
+// longPollIdleAfter is how long after its last poll a long_poll connection
+// no longer counts as being polled
+const longPollIdleAfter = 5 * time.Second
+
+func NewConnectionManager(redisClient *redis.Client, cfg *config.Config) *ConnectionManager {
 	cm := &ConnectionManager{
 		redisClient: redisClient,
 		connections: make(map[string]*types.Connection),
+		topics:      make(map[string]map[string]struct{}),
 		startTime:   time.Now(),
+		nodeID:      cfg.Server.NodeID,
+		replay:      cfg.Replay,
+		pubsub:      redisClient.Subscribe(clusterChannel),
+
+		backpressure: cfg.Backpressure,
+		blocked:      blockedQueues{queues: make(map[string]*blockedQueue)},
+	}
+
+	if policy, err := ParseBackpressurePolicy(cm.backpressure.Policy); err != nil || policy == "" {
+		log.Printf("Invalid default backpressure policy %q, using drop_newest", cm.backpressure.Policy)
+		cm.backpressure.Policy = string(types.BackpressureDropNewest)
 	}
 
 	// Start background processes
 	go cm.startHeartbeat()
 	go cm.startCleanup()
+	go cm.startClusterSubscriber()
 
 	return cm
 }
 
-// AddConnection adds a new SSE connection
-func (cm *ConnectionManager) AddConnection(clientID, userID string, metadata map[string]string) *types.Connection {
+// ConnectionOptions are the delivery settings of a connection. They are
+// fixed when the connection is added, since delivery reads them without
+// holding the manager lock.
+type ConnectionOptions struct {
+	Filter       *types.EventFilter
+	Backpressure types.BackpressurePolicy // empty for the server default
+}
+
+// AddConnection adds a new client connection served over the given transport
+func (cm *ConnectionManager) AddConnection(clientID, userID, transport string, metadata map[string]string, options ConnectionOptions) *types.Connection {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
 
+	backpressure := options.Backpressure
+	if backpressure == "" {
+		backpressure = types.BackpressurePolicy(cm.backpressure.Policy)
+	}
+
 	connectionID := uuid.New().String()
 	connection := &types.Connection{
-		ID:        connectionID,
-		ClientID:  clientID,
-		UserID:    userID,
-		Channel:   make(chan types.SSEMessage, 100), // Buffer for messages
-		Metadata:  metadata,
-		CreatedAt: time.Now(),
-		LastPing:  time.Now(),
-		Active:    true,
+		ID:           connectionID,
+		ClientID:     clientID,
+		UserID:       userID,
+		Transport:    transport,
+		Channel:      make(chan types.SSEMessage, 100), // Buffer for messages
+		Done:         make(chan struct{}),
+		Metadata:     metadata,
+		Filter:       options.Filter,
+		Backpressure: backpressure,
+		CreatedAt:    time.Now(),
+		LastPing:     time.Now(),
+		Active:       true,
 	}
 
 	cm.connections[connectionID] = connection
 
 	// Store in Redis
-	if err := cm.redisClient.StoreConnection(connection); err != nil {
+	if err := cm.redisClient.StoreConnection(snapshotConnection(connection)); err != nil {
 		log.Printf("Failed to store connection in Redis: %v", err)
 	}
 
 	// Increment connection counter
 	cm.redisClient.IncrementCounter("total_connections")
 
-	log.Printf("Added connection: %s for client: %s", connectionID, clientID)
+	log.Printf("Added %s connection: %s for client: %s", transport, connectionID, clientID)
 	return connection
 }
 
@@ -71,8 +120,9 @@ func (cm *ConnectionManager) RemoveConnection(connectionID string) {
 
 	if connection, exists := cm.connections[connectionID]; exists {
 		connection.Active = false
-		close(connection.Channel)
+		close(connection.Done)
 		delete(cm.connections, connectionID)
+		cm.removeConnectionTopicsLocked(connection)
 
 		// Remove from Redis
 		if err := cm.redisClient.DeleteConnection(connectionID); err != nil {
@@ -91,6 +141,39 @@ func (cm *ConnectionManager) GetConnection(connectionID string) *types.Connectio
 	return cm.connections[connectionID]
 }
 
+// GetConnectionOwner returns the client and user of a connection on any
+// node
+func (cm *ConnectionManager) GetConnectionOwner(connectionID string) (clientID, userID string, err error) {
+	cm.mutex.RLock()
+	connection, exists := cm.connections[connectionID]
+	if exists {
+		clientID, userID = connection.ClientID, connection.UserID
+	}
+	cm.mutex.RUnlock()
+	if exists {
+		return clientID, userID, nil
+	}
+
+	stored, err := cm.redisClient.GetConnection(connectionID)
+	if err != nil {
+		return "", "", ErrConnectionNotFound
+	}
+	return stored.ClientID, stored.UserID, nil
+}
+
+// GetConnectionTopics returns a copy of the topics a local connection is
+// subscribed to
+func (cm *ConnectionManager) GetConnectionTopics(connectionID string) []string {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	connection, exists := cm.connections[connectionID]
+	if !exists {
+		return nil
+	}
+	return append([]string{}, connection.Topics...)
+}
+
 // GetConnectionsByClientID retrieves all connections for a client
 func (cm *ConnectionManager) GetConnectionsByClientID(clientID string) []*types.Connection {
 	cm.mutex.RLock()
@@ -106,6 +189,21 @@ func (cm *ConnectionManager) GetConnectionsByClientID(clientID string) []*types.
 	return clientConnections
 }
 
+// GetConnectionsByUserID retrieves all local connections for a user
+func (cm *ConnectionManager) GetConnectionsByUserID(userID string) []*types.Connection {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	var userConnections []*types.Connection
+	for _, conn := range cm.connections {
+		if conn.UserID == userID {
+			userConnections = append(userConnections, conn)
+		}
+	}
+
+	return userConnections
+}
+
 // GetAllConnections returns all active connections
 func (cm *ConnectionManager) GetAllConnections() []*types.Connection {
 	cm.mutex.RLock()
@@ -119,6 +217,41 @@ func (cm *ConnectionManager) GetAllConnections() []*types.Connection {
 	return connections
 }
 
+// GetConnectionSnapshots returns copies of all active connections that are
+// safe to serialize while messages are being delivered
+func (cm *ConnectionManager) GetConnectionSnapshots() []*types.Connection {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	connections := make([]*types.Connection, 0, len(cm.connections))
+	for _, conn := range cm.connections {
+		connections = append(connections, snapshotConnection(conn))
+	}
+
+	return connections
+}
+
+// snapshotConnection copies a connection for serialization. The drop
+// counters are updated atomically during delivery, so they are loaded
+// rather than copied with the struct. cm.mutex must be held.
+func snapshotConnection(connection *types.Connection) *types.Connection {
+	return &types.Connection{
+		ID:              connection.ID,
+		ClientID:        connection.ClientID,
+		UserID:          connection.UserID,
+		Transport:       connection.Transport,
+		Metadata:        connection.Metadata,
+		Topics:          append([]string(nil), connection.Topics...),
+		Filter:          connection.Filter,
+		Backpressure:    connection.Backpressure,
+		DroppedMessages: atomic.LoadUint64(&connection.DroppedMessages),
+		PendingOverflow: atomic.LoadUint64(&connection.PendingOverflow),
+		CreatedAt:       connection.CreatedAt,
+		LastPing:        connection.LastPing,
+		Active:          connection.Active,
+	}
+}
+
 // SendToConnection sends a message to a specific connection
 func (cm *ConnectionManager) SendToConnection(connectionID string, message types.SSEMessage) error {
 	cm.mutex.RLock()
@@ -129,38 +262,99 @@ func (cm *ConnectionManager) SendToConnection(connectionID string, message types
 		return ErrConnectionNotFound
 	}
 
-	select {
-	case connection.Channel <- message:
+	if !MatchesFilter(connection.Filter, message) {
 		return nil
-	default:
-		log.Printf("Connection %s channel is full, dropping message", connectionID)
-		return ErrChannelFull
 	}
+
+	return cm.enqueue(connection, message)
 }
 
-// BroadcastToClient sends a message to all connections of a client
+// BroadcastToClient sends a message to all connections of a client on every
+// node. The message is recorded in the client's replay log first, which
+// assigns the event ID reconnecting clients send back as Last-Event-ID.
 func (cm *ConnectionManager) BroadcastToClient(clientID string, message types.SSEMessage) {
-	connections := cm.GetConnectionsByClientID(clientID)
-	
-	for _, conn := range connections {
+	if cm.replay.Size > 0 {
+		logged, err := cm.redisClient.AppendToReplayLog(clientID, message, cm.replay.Size, cm.replay.TTL)
+		if err != nil {
+			log.Printf("Failed to append message to replay log for client %s: %v", clientID, err)
+		} else {
+			message = logged
+		}
+	}
+
+	cm.deliverToClient(clientID, message)
+	cm.publishToCluster(scopeClient, clientID, message)
+}
+
+// SendToClient sends a message to all connections of a client on every node
+// without recording it in the replay log, for transient messages such as
+// streamed chunks that would otherwise crowd out the client's history
+func (cm *ConnectionManager) SendToClient(clientID string, message types.SSEMessage) {
+	cm.deliverToClient(clientID, message)
+	cm.publishToCluster(scopeClient, clientID, message)
+}
+
+// BroadcastToUser sends a message to all connections of a user on every node
+func (cm *ConnectionManager) BroadcastToUser(userID string, message types.SSEMessage) {
+	cm.deliverToUser(userID, message)
+	cm.publishToCluster(scopeUser, userID, message)
+}
+
+// BroadcastToAll sends a message to all active connections on every node
+func (cm *ConnectionManager) BroadcastToAll(message types.SSEMessage) {
+	cm.deliverToAll(message)
+	cm.publishToCluster(scopeAll, "", message)
+}
+
+// deliverToClient sends a message to the local connections of a client
+func (cm *ConnectionManager) deliverToClient(clientID string, message types.SSEMessage) {
+	for _, conn := range cm.GetConnectionsByClientID(clientID) {
 		if err := cm.SendToConnection(conn.ID, message); err != nil {
 			log.Printf("Failed to send message to connection %s: %v", conn.ID, err)
 		}
 	}
 }
 
-// BroadcastToAll sends a message to all active connections
-func (cm *ConnectionManager) BroadcastToAll(message types.SSEMessage) {
-	cm.mutex.RLock()
-	defer cm.mutex.RUnlock()
+// deliverToUser sends a message to the local connections of a user
+func (cm *ConnectionManager) deliverToUser(userID string, message types.SSEMessage) {
+	for _, conn := range cm.GetConnectionsByUserID(userID) {
+		if err := cm.SendToConnection(conn.ID, message); err != nil {
+			log.Printf("Failed to send message to connection %s: %v", conn.ID, err)
+		}
+	}
+}
 
-	for connectionID := range cm.connections {
-		if err := cm.SendToConnection(connectionID, message); err != nil {
-			log.Printf("Failed to broadcast to connection %s: %v", connectionID, err)
+// deliverToAll sends a message to every local connection
+func (cm *ConnectionManager) deliverToAll(message types.SSEMessage) {
+	for _, conn := range cm.GetAllConnections() {
+		if err := cm.SendToConnection(conn.ID, message); err != nil {
+			log.Printf("Failed to broadcast to connection %s: %v", conn.ID, err)
 		}
 	}
 }
 
+// GetReplayCursor returns the event ID of the latest message logged for a
+// client, so a new connection can later resume from that point.
+func (cm *ConnectionManager) GetReplayCursor(clientID string) string {
+	seq, err := cm.redisClient.GetReplaySequence(clientID)
+	if err != nil {
+		log.Printf("Failed to read replay cursor for client %s: %v", clientID, err)
+		return ""
+	}
+	return strconv.FormatInt(seq, 10)
+}
+
+// ReplaySince returns the messages sent to a client after lastEventID. The
+// returned bool is true when the replay log no longer covers lastEventID.
+func (cm *ConnectionManager) ReplaySince(clientID, lastEventID string) ([]types.SSEMessage, bool, error) {
+	after, err := strconv.ParseInt(lastEventID, 10, 64)
+	if err != nil || after < 0 {
+		return nil, false, ErrInvalidEventID
+	}
+
+	return cm.redisClient.GetReplayMessages(clientID, after)
+}
+
 // UpdateLastPing updates the last ping time for a connection
 func (cm *ConnectionManager) UpdateLastPing(connectionID string) {
 	cm.mutex.Lock()
@@ -170,7 +364,7 @@ func (cm *ConnectionManager) UpdateLastPing(connectionID string) {
 		connection.LastPing = time.Now()
 
 		// Update in Redis
-		if err := cm.redisClient.StoreConnection(connection); err != nil {
+		if err := cm.redisClient.StoreConnection(snapshotConnection(connection)); err != nil {
 			log.Printf("Failed to update connection ping in Redis: %v", err)
 		}
 	}
@@ -182,15 +376,28 @@ func (cm *ConnectionManager) GetStats() map[string]interface{} {
 	defer cm.mutex.RUnlock()
 
 	clientCount := make(map[string]int)
+	transportCount := make(map[string]int)
 	for _, conn := range cm.connections {
 		clientCount[conn.ClientID]++
+		transportCount[conn.Transport]++
+	}
+
+	topicCount := make(map[string]int, len(cm.topics))
+	for topic, members := range cm.topics {
+		topicCount[topic] = len(members)
 	}
 
 	return map[string]interface{}{
-		"total_connections":  len(cm.connections),
-		"unique_clients":     len(clientCount),
-		"uptime_seconds":     time.Since(cm.startTime).Seconds(),
-		"clients_breakdown":  clientCount,
+		"node_id":              cm.nodeID,
+		"total_connections":    len(cm.connections),
+		"unique_clients":       len(clientCount),
+		"uptime_seconds":       time.Since(cm.startTime).Seconds(),
+		"clients_breakdown":    clientCount,
+		"transports_breakdown": transportCount,
+		"total_topics":         len(topicCount),
+		"topics_breakdown":     topicCount,
+		"dropped_messages":     atomic.LoadUint64(&cm.droppedMessages),
+		"slow_disconnects":     atomic.LoadUint64(&cm.slowDisconnects),
 	}
 }
 
@@ -205,7 +412,19 @@ func (cm *ConnectionManager) startHeartbeat() {
 			Data:  map[string]interface{}{"timestamp": time.Now().Unix()},
 		}
 
-		cm.BroadcastToAll(heartbeat)
+		// Heartbeats are per node, so they skip the cluster bus. Polling
+		// clients discard them, and a draining node stops sending them so
+		// they do not hold up the drain.
+		if atomic.LoadInt32(&cm.draining) == 0 {
+			for _, conn := range cm.GetAllConnections() {
+				if conn.Transport == types.TransportLongPoll {
+					continue
+				}
+				if err := cm.SendToConnection(conn.ID, heartbeat); err != nil {
+					log.Printf("Failed to send heartbeat to connection %s: %v", conn.ID, err)
+				}
+			}
+		}
 
 		// Update metrics
 		stats := cm.GetStats()
@@ -234,8 +453,9 @@ func (cm *ConnectionManager) cleanup() {
 		if now.Sub(connection.LastPing) > staleThreshold {
 			log.Printf("Cleaning up stale connection: %s", connectionID)
 			connection.Active = false
-			close(connection.Channel)
+			close(connection.Done)
 			delete(cm.connections, connectionID)
+			cm.removeConnectionTopicsLocked(connection)
 
 			// Remove from Redis
 			cm.redisClient.DeleteConnection(connectionID)
@@ -243,6 +463,49 @@ func (cm *ConnectionManager) cleanup() {
 	}
 }
 
+// NotifyDraining tells every local connection that this node is going away.
+// Each connection gets its own reconnect delay from retryDelay so clients
+// do not all reconnect at once.
+func (cm *ConnectionManager) NotifyDraining(retryDelay func() time.Duration) {
+	atomic.StoreInt32(&cm.draining, 1)
+
+	for _, conn := range cm.GetAllConnections() {
+		delay := retryDelay()
+		message := types.SSEMessage{
+			Event: "server_draining",
+			Retry: int(delay.Milliseconds()),
+			Data: map[string]interface{}{
+				"node_id":   cm.nodeID,
+				"retry_ms":  delay.Milliseconds(),
+				"timestamp": time.Now().Unix(),
+				"message":   "Server is shutting down, reconnect after retry_ms",
+			},
+		}
+
+		if err := cm.SendToConnection(conn.ID, message); err != nil {
+			log.Printf("Failed to send drain notice to connection %s: %v", conn.ID, err)
+		}
+	}
+}
+
+// PendingMessages returns the number of messages queued on local
+// connections that have not been written to clients yet. Long-poll
+// connections nobody has polled recently are left out, since their queue
+// would only be read by a poll that may never come.
+func (cm *ConnectionManager) PendingMessages() int {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	pending := 0
+	for _, conn := range cm.connections {
+		if conn.Transport == types.TransportLongPoll && time.Since(conn.LastPing) > longPollIdleAfter {
+			continue
+		}
+		pending += len(conn.Channel) + cm.blockedMessages(conn.ID)
+	}
+	return pending
+}
+
 // Shutdown gracefully shuts down the connection manager
 func (cm *ConnectionManager) Shutdown() {
 	cm.mutex.Lock()
@@ -250,18 +513,25 @@ func (cm *ConnectionManager) Shutdown() {
 
 	log.Println("Shutting down connection manager...")
 
+	if err := cm.pubsub.Close(); err != nil {
+		log.Printf("Failed to close cluster subscription: %v", err)
+	}
+
 	for connectionID, connection := range cm.connections {
 		connection.Active = false
-		close(connection.Channel)
+		close(connection.Done)
 		cm.redisClient.DeleteConnection(connectionID)
 	}
 
 	cm.connections = make(map[string]*types.Connection)
+	cm.topics = make(map[string]map[string]struct{})
 	log.Println("Connection manager shutdown complete")
 }
 
 // Custom errors
 var (
 	ErrConnectionNotFound = fmt.Errorf("connection not found")
-	ErrChannelFull       = fmt.Errorf("connection channel is full")
+	ErrChannelFull        = fmt.Errorf("connection channel is full")
+	ErrInvalidEventID     = fmt.Errorf("invalid event ID")
+	ErrSlowConsumer       = fmt.Errorf("slow consumer disconnected")
 )
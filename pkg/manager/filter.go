@@ -0,0 +1,187 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"virtualization-manager/pkg/types"
+)
+
+const maxFilterPredicates = 10
+
+// systemEvents are always delivered so that filtered connections still see
+// connection lifecycle, keep-alive traffic and replies to their own requests
+var systemEvents = map[string]bool{
+	"connected":           true,
+	"heartbeat":           true,
+	"gap":                 true,
+	"server_draining":     true,
+	"error":               true,
+	"pong":                true,
+	"invocation_accepted": true,
+	"subscribed":          true,
+	"unsubscribed":        true,
+}
+
+var predicatePattern = regexp.MustCompile(`^([A-Za-z0-9_.\-]+)\s*(==|!=|>=|<=|>|<|=)\s*(.*)$`)
+
+// ParseEventFilter builds a filter from the events and filter query
+// parameters, e.g. ?events=orders,prices&filter=status==done&filter=total>100.
+// It returns nil when neither is set.
+func ParseEventFilter(query url.Values) (*types.EventFilter, error) {
+	events := ParseTopics(query.Get("events"))
+	expressions := query["filter"]
+
+	if len(events) == 0 && len(expressions) == 0 {
+		return nil, nil
+	}
+	if len(expressions) > maxFilterPredicates {
+		return nil, fmt.Errorf("at most %d filter predicates are allowed", maxFilterPredicates)
+	}
+
+	filter := &types.EventFilter{Events: events}
+	for _, expression := range expressions {
+		match := predicatePattern.FindStringSubmatch(strings.TrimSpace(expression))
+		if match == nil {
+			return nil, fmt.Errorf("invalid filter %q, expected <field><op><value> with op one of == != > >= < <=", expression)
+		}
+
+		operator := match[2]
+		if operator == "=" {
+			operator = "=="
+		}
+
+		filter.Predicates = append(filter.Predicates, types.FieldPredicate{
+			Field:    match[1],
+			Operator: operator,
+			Value:    match[3],
+		})
+	}
+
+	return filter, nil
+}
+
+// MatchesFilter reports whether a message should be delivered to a
+// connection with the given filter
+func MatchesFilter(filter *types.EventFilter, message types.SSEMessage) bool {
+	if filter == nil || systemEvents[message.Event] {
+		return true
+	}
+
+	if len(filter.Events) > 0 {
+		allowed := false
+		for _, event := range filter.Events {
+			if event == message.Event {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	if len(filter.Predicates) == 0 {
+		return true
+	}
+
+	data, ok := normalizeData(message.Data)
+	if !ok {
+		return false
+	}
+
+	for _, predicate := range filter.Predicates {
+		if !matchesPredicate(predicate, data) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// normalizeData converts message data into generic JSON values so fields
+// can be looked up by path regardless of the Go type it was built from.
+// Maps are converted too: values such as int64 timestamps must compare the
+// same as on other nodes, which receive the data as decoded JSON.
+func normalizeData(data interface{}) (interface{}, bool) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, false
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
+
+func matchesPredicate(predicate types.FieldPredicate, data interface{}) bool {
+	value, found := lookupField(data, predicate.Field)
+	if !found {
+		return false
+	}
+
+	actualNumber, actualIsNumber := toNumber(value)
+	expectedNumber, expectedIsNumber := toNumber(predicate.Value)
+
+	if actualIsNumber && expectedIsNumber {
+		switch predicate.Operator {
+		case "==":
+			return actualNumber == expectedNumber
+		case "!=":
+			return actualNumber != expectedNumber
+		case ">":
+			return actualNumber > expectedNumber
+		case ">=":
+			return actualNumber >= expectedNumber
+		case "<":
+			return actualNumber < expectedNumber
+		case "<=":
+			return actualNumber <= expectedNumber
+		}
+		return false
+	}
+
+	actual := fmt.Sprint(value)
+	switch predicate.Operator {
+	case "==":
+		return actual == predicate.Value
+	case "!=":
+		return actual != predicate.Value
+	}
+
+	// Ordering is only defined for numbers
+	return false
+}
+
+// lookupField walks a dotted path through nested JSON objects
+func lookupField(data interface{}, path string) (interface{}, bool) {
+	current := data
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		return parsed, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,171 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"virtualization-manager/pkg/types"
+)
+
+// ParseTopics splits a comma-separated topic list, dropping blanks and
+// duplicates
+func ParseTopics(value string) []string {
+	seen := make(map[string]bool)
+	var topics []string
+	for _, topic := range strings.Split(value, ",") {
+		topic = strings.TrimSpace(topic)
+		if topic == "" || seen[topic] {
+			continue
+		}
+		seen[topic] = true
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// ValidateTopic checks that a topic name can be used in subscriptions
+func ValidateTopic(topic string) error {
+	if strings.TrimSpace(topic) == "" {
+		return fmt.Errorf("topic name is required")
+	}
+	if strings.ContainsAny(topic, ", \t\n") {
+		return fmt.Errorf("topic name %q must not contain commas or whitespace", topic)
+	}
+	return nil
+}
+
+// Subscribe adds topics to a connection. Connections held by another node
+// are updated through the cluster bus; the returned bool reports whether the
+// connection was local.
+func (cm *ConnectionManager) Subscribe(connectionID string, topics []string) (bool, error) {
+	if cm.subscribeLocal(connectionID, topics) {
+		return true, nil
+	}
+
+	if _, err := cm.redisClient.GetConnection(connectionID); err != nil {
+		return false, ErrConnectionNotFound
+	}
+
+	cm.publishSubscription(scopeSubscribe, connectionID, topics)
+	return false, nil
+}
+
+// Unsubscribe removes topics from a connection, locally or through the
+// cluster bus like Subscribe
+func (cm *ConnectionManager) Unsubscribe(connectionID string, topics []string) (bool, error) {
+	if cm.unsubscribeLocal(connectionID, topics) {
+		return true, nil
+	}
+
+	if _, err := cm.redisClient.GetConnection(connectionID); err != nil {
+		return false, ErrConnectionNotFound
+	}
+
+	cm.publishSubscription(scopeUnsubscribe, connectionID, topics)
+	return false, nil
+}
+
+// PublishToTopic sends a message to every subscriber of a topic on every node
+func (cm *ConnectionManager) PublishToTopic(topic string, message types.SSEMessage) {
+	cm.deliverToTopic(topic, message)
+	cm.publishToCluster(scopeTopic, topic, message)
+}
+
+// deliverToTopic sends a message to the local subscribers of a topic
+func (cm *ConnectionManager) deliverToTopic(topic string, message types.SSEMessage) {
+	cm.mutex.RLock()
+	connectionIDs := make([]string, 0, len(cm.topics[topic]))
+	for connectionID := range cm.topics[topic] {
+		connectionIDs = append(connectionIDs, connectionID)
+	}
+	cm.mutex.RUnlock()
+
+	for _, connectionID := range connectionIDs {
+		if err := cm.SendToConnection(connectionID, message); err != nil {
+			log.Printf("Failed to send topic %s message to connection %s: %v", topic, connectionID, err)
+		}
+	}
+}
+
+func (cm *ConnectionManager) subscribeLocal(connectionID string, topics []string) bool {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	connection, exists := cm.connections[connectionID]
+	if !exists {
+		return false
+	}
+
+	for _, topic := range topics {
+		if cm.topics[topic] == nil {
+			cm.topics[topic] = make(map[string]struct{})
+		}
+		cm.topics[topic][connectionID] = struct{}{}
+	}
+	cm.syncConnectionTopicsLocked(connection, topics)
+
+	log.Printf("Connection %s subscribed to topics: %s", connectionID, strings.Join(topics, ","))
+	return true
+}
+
+func (cm *ConnectionManager) unsubscribeLocal(connectionID string, topics []string) bool {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	connection, exists := cm.connections[connectionID]
+	if !exists {
+		return false
+	}
+
+	for _, topic := range topics {
+		cm.removeTopicMemberLocked(topic, connectionID)
+	}
+	cm.syncConnectionTopicsLocked(connection, topics)
+
+	log.Printf("Connection %s unsubscribed from topics: %s", connectionID, strings.Join(topics, ","))
+	return true
+}
+
+// removeConnectionTopicsLocked drops a connection from every topic it is
+// subscribed to. The caller must hold the write lock.
+func (cm *ConnectionManager) removeConnectionTopicsLocked(connection *types.Connection) {
+	for _, topic := range connection.Topics {
+		cm.removeTopicMemberLocked(topic, connection.ID)
+	}
+}
+
+func (cm *ConnectionManager) removeTopicMemberLocked(topic, connectionID string) {
+	members, exists := cm.topics[topic]
+	if !exists {
+		return
+	}
+
+	delete(members, connectionID)
+	if len(members) == 0 {
+		delete(cm.topics, topic)
+	}
+}
+
+// syncConnectionTopicsLocked refreshes the connection's topic list from the
+// index and persists it. The caller must hold the write lock.
+func (cm *ConnectionManager) syncConnectionTopicsLocked(connection *types.Connection, changed []string) {
+	current := make(map[string]bool)
+	for _, topic := range append(connection.Topics, changed...) {
+		if _, subscribed := cm.topics[topic][connection.ID]; subscribed {
+			current[topic] = true
+		}
+	}
+
+	topics := make([]string, 0, len(current))
+	for topic := range current {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	connection.Topics = topics
+
+	if err := cm.redisClient.StoreConnection(snapshotConnection(connection)); err != nil {
+		log.Printf("Failed to update connection topics in Redis: %v", err)
+	}
+}
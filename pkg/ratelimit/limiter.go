@@ -0,0 +1,238 @@
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"virtualization-manager/pkg/config"
+	"virtualization-manager/pkg/redis"
+	"virtualization-manager/pkg/types"
+)
+
+// Limit allows Requests invocations per Period, with bursts of up to
+// Requests. The zero Limit is disabled.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func (l Limit) enabled() bool {
+	return l.Requests > 0 && l.Period > 0
+}
+
+// ParseLimit parses "requests/period" such as "100/1m", "10/s" or "5/500ms".
+// "" and "none" return the disabled Limit.
+func ParseLimit(spec string) (Limit, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "none" {
+		return Limit{}, nil
+	}
+
+	count, period, found := strings.Cut(spec, "/")
+	if !found {
+		return Limit{}, fmt.Errorf("rate limit %q must be requests/period", spec)
+	}
+
+	requests, err := strconv.Atoi(count)
+	if err != nil || requests <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q: requests must be a positive integer", spec)
+	}
+
+	// Allow a bare unit such as "s" or "m" as shorthand for "1s" or "1m"
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	duration, err := time.ParseDuration(period)
+	if err != nil || duration <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q: invalid period", spec)
+	}
+
+	return Limit{Requests: requests, Period: duration}, nil
+}
+
+// Decision is the outcome of a rate limit check
+type Decision struct {
+	Allowed    bool
+	Scope      string
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+// Limiter enforces token-bucket rate limits on invocations. Buckets live in
+// Redis so every replica shares them.
+type Limiter struct {
+	redisClient *redis.Client
+	global      Limit
+	function    Limit
+	client      Limit
+	user        Limit
+
+	mutex sync.Mutex
+	hits  map[string]uint64
+}
+
+func NewLimiter(redisClient *redis.Client, cfg *config.Config) (*Limiter, error) {
+	l := &Limiter{
+		redisClient: redisClient,
+		hits:        make(map[string]uint64),
+	}
+
+	var err error
+	if l.global, err = ParseLimit(cfg.RateLimit.Global); err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_GLOBAL: %v", err)
+	}
+	if l.function, err = ParseLimit(cfg.RateLimit.Function); err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_FUNCTION: %v", err)
+	}
+	if l.client, err = ParseLimit(cfg.RateLimit.Client); err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_CLIENT: %v", err)
+	}
+	if l.user, err = ParseLimit(cfg.RateLimit.User); err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_USER: %v", err)
+	}
+
+	return l, nil
+}
+
+type bucket struct {
+	scope string
+	limit Limit
+	key   string
+}
+
+// Allow takes a token from every bucket that applies to the invocation.
+// If Redis is unavailable the invocation is allowed.
+func (l *Limiter) Allow(function *types.Function, clientID, userID string) Decision {
+	buckets := l.bucketsFor(function, clientID, userID)
+	if len(buckets) == 0 {
+		return Decision{Allowed: true}
+	}
+
+	rateBuckets := make([]redis.RateBucket, len(buckets))
+	for i, b := range buckets {
+		rateBuckets[i] = redis.RateBucket{
+			Key:   b.key,
+			Rate:  float64(b.limit.Requests) / b.limit.Period.Seconds(),
+			Burst: b.limit.Requests,
+		}
+	}
+
+	denied, retryAfter, remaining, err := l.redisClient.TakeTokens(rateBuckets)
+	if err != nil {
+		log.Printf("Rate limit check failed, allowing invocation of %s: %v", function.Name, err)
+		return Decision{Allowed: true}
+	}
+
+	if denied >= 0 {
+		b := buckets[denied]
+		l.recordHit(b.scope)
+		return Decision{
+			Scope:      b.scope,
+			Limit:      b.limit.Requests,
+			RetryAfter: retryAfter,
+		}
+	}
+
+	// Report the bucket closest to running out
+	tightest := 0
+	for i := range remaining {
+		if remaining[i] < remaining[tightest] {
+			tightest = i
+		}
+	}
+	return Decision{
+		Allowed:   true,
+		Scope:     buckets[tightest].scope,
+		Limit:     buckets[tightest].limit.Requests,
+		Remaining: int(remaining[tightest]),
+	}
+}
+
+// bucketsFor lists the enabled limits for an invocation. A function's own
+// client or user limit is tracked separately from the default one.
+func (l *Limiter) bucketsFor(function *types.Function, clientID, userID string) []bucket {
+	policy := function.RateLimit
+	if policy == nil {
+		policy = &types.RateLimitPolicy{}
+	}
+
+	var buckets []bucket
+	add := func(scope string, limit Limit, key string) {
+		if limit.enabled() {
+			buckets = append(buckets, bucket{scope: scope, limit: limit, key: "ratelimit:" + key})
+		}
+	}
+
+	add("global", l.global, "global")
+	add("function", l.override(policy.Function, l.function), "function:"+function.Name)
+
+	if clientID != "" {
+		if policy.Client != "" {
+			add("client", l.override(policy.Client, l.client), "function:"+function.Name+":client:"+clientID)
+		} else {
+			add("client", l.client, "client:"+clientID)
+		}
+	}
+
+	if userID != "" {
+		if policy.User != "" {
+			add("user", l.override(policy.User, l.user), "function:"+function.Name+":user:"+userID)
+		} else {
+			add("user", l.user, "user:"+userID)
+		}
+	}
+
+	return buckets
+}
+
+// override parses a function's limit, falling back to the default when it
+// is unset. Policies are validated on registration.
+func (l *Limiter) override(spec string, fallback Limit) Limit {
+	if spec == "" {
+		return fallback
+	}
+	limit, err := ParseLimit(spec)
+	if err != nil {
+		return fallback
+	}
+	return limit
+}
+
+func (l *Limiter) recordHit(scope string) {
+	l.mutex.Lock()
+	l.hits[scope]++
+	l.mutex.Unlock()
+
+	if err := l.redisClient.IncrementCounter("metrics:rate_limited:" + scope); err != nil {
+		log.Printf("Failed to count rate limit hit: %v", err)
+	}
+}
+
+// GetStats returns the rate limit hits on this instance by scope
+func (l *Limiter) GetStats() map[string]interface{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	hits := make(map[string]uint64, len(l.hits))
+	var total uint64
+	for scope, count := range l.hits {
+		hits[scope] = count
+		total += count
+	}
+
+	return map[string]interface{}{
+		"rate_limited":          total,
+		"rate_limited_by_scope": hits,
+	}
+}
+
+// RetryAfterSeconds rounds a retry delay up to whole seconds for headers
+func RetryAfterSeconds(d time.Duration) int {
+	return int(math.Max(1, math.Ceil(d.Seconds())))
+}
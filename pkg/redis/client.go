@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"virtualization-manager/pkg/config"
@@ -81,14 +82,50 @@ func (c *Client) GetAllConnections() ([]*types.Connection, error) {
 }
 
 // Function registry
-func (c *Client) StoreFunction(fn *types.Function) error {
+// Every change to a function takes a number from one counter, so replicas
+// can tell which of two copies of a function is newer
+func (c *Client) NextFunctionGeneration() (int64, error) {
+	return c.rdb.Incr(c.ctx, "function_generation").Result()
+}
+
+func (c *Client) GetFunctionGeneration() (int64, error) {
+	generation, err := c.rdb.Get(c.ctx, "function_generation").Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return generation, err
+}
+
+// compareAndSetFunctionScript replaces or deletes (empty ARGV[2]) a function
+// only if the stored copy is still at the generation the change was based on
+var compareAndSetFunctionScript = redis.NewScript(`
+local stored = redis.call('GET', KEYS[1])
+local current = 0
+if stored then
+  current = tonumber(cjson.decode(stored)['generation']) or 0
+end
+if current ~= tonumber(ARGV[1]) then
+  return 0
+end
+if ARGV[2] == '' then
+  redis.call('DEL', KEYS[1])
+else
+  redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// StoreFunction stores fn unless the stored copy has changed since
+// generation expected. It reports whether fn was stored.
+func (c *Client) StoreFunction(fn *types.Function, expected int64) (bool, error) {
 	data, err := json.Marshal(fn)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	key := fmt.Sprintf("functions:%s", fn.Name)
-	return c.rdb.Set(c.ctx, key, data, 0).Err() // No expiration for functions
+	stored, err := compareAndSetFunctionScript.Run(c.ctx, c.rdb, []string{key}, expected, data).Int()
+	return stored == 1, err
 }
 
 func (c *Client) GetFunction(name string) (*types.Function, error) {
@@ -125,9 +162,436 @@ func (c *Client) GetAllFunctions() ([]*types.Function, error) {
 	return functions, nil
 }
 
-func (c *Client) DeleteFunction(name string) error {
+// DeleteFunction deletes a function unless the stored copy has changed since
+// generation expected. It reports whether the function was deleted.
+func (c *Client) DeleteFunction(name string, expected int64) (bool, error) {
 	key := fmt.Sprintf("functions:%s", name)
-	return c.rdb.Del(c.ctx, key).Err()
+	deleted, err := compareAndSetFunctionScript.Run(c.ctx, c.rdb, []string{key}, expected, "").Int()
+	return deleted == 1, err
+}
+
+// Function revisions are kept in one hash per function and never rewritten
+func (c *Client) NextFunctionRevision(name string) (int64, error) {
+	return c.rdb.Incr(c.ctx, fmt.Sprintf("function_revisions:%s:seq", name)).Result()
+}
+
+func (c *Client) StoreFunctionRevision(fn *types.Function) error {
+	data, err := json.Marshal(fn)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("function_revisions:%s", fn.Name)
+	stored, err := c.rdb.HSetNX(c.ctx, key, strconv.Itoa(fn.Revision), data).Result()
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return fmt.Errorf("revision %d of %s already exists", fn.Revision, fn.Name)
+	}
+	return nil
+}
+
+func (c *Client) GetFunctionRevision(name string, revision int) (*types.Function, error) {
+	key := fmt.Sprintf("function_revisions:%s", name)
+	data, err := c.rdb.HGet(c.ctx, key, strconv.Itoa(revision)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var fn types.Function
+	err = json.Unmarshal([]byte(data), &fn)
+	return &fn, err
+}
+
+func (c *Client) GetFunctionRevisions(name string) ([]*types.Function, error) {
+	key := fmt.Sprintf("function_revisions:%s", name)
+	entries, err := c.rdb.HGetAll(c.ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	functions := make([]*types.Function, 0, len(entries))
+	for _, data := range entries {
+		var fn types.Function
+		if err := json.Unmarshal([]byte(data), &fn); err == nil {
+			functions = append(functions, &fn)
+		}
+	}
+	return functions, nil
+}
+
+// Replay log
+
+// appendToReplayLogScript numbers a message and logs it in one step, so
+// concurrent appends cannot store messages out of sequence order and a
+// failure cannot use up a sequence number without logging the message.
+// ARGV[1] is the message JSON without an id, which always has a data field.
+var appendToReplayLogScript = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[2])
+local entry = '{"id":"' .. seq .. '",' .. string.sub(ARGV[1], 2)
+redis.call('LPUSH', KEYS[1], entry)
+redis.call('LTRIM', KEYS[1], 0, tonumber(ARGV[2]) - 1)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+return seq
+`)
+
+func (c *Client) AppendToReplayLog(clientID string, message types.SSEMessage, size int, ttl time.Duration) (types.SSEMessage, error) {
+	message.ID = ""
+	data, err := json.Marshal(message)
+	if err != nil {
+		return message, err
+	}
+
+	keys := []string{fmt.Sprintf("replay:%s", clientID), fmt.Sprintf("replay:%s:seq", clientID)}
+	seq, err := appendToReplayLogScript.Run(c.ctx, c.rdb, keys, data, size, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return message, err
+	}
+
+	message.ID = strconv.FormatInt(seq, 10)
+	return message, nil
+}
+
+func (c *Client) GetReplaySequence(clientID string) (int64, error) {
+	seq, err := c.rdb.Get(c.ctx, fmt.Sprintf("replay:%s:seq", clientID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// GetReplayMessages returns the logged messages for a client with a sequence
+// greater than after, oldest first. The returned bool reports a gap: messages
+// after the given sequence were trimmed or expired and cannot be replayed.
+func (c *Client) GetReplayMessages(clientID string, after int64) ([]types.SSEMessage, bool, error) {
+	seq, err := c.GetReplaySequence(clientID)
+	if err != nil {
+		return nil, false, err
+	}
+	if seq <= after {
+		// Either nothing was sent since, or the log expired or was reset
+		// and the sequence restarted below the given one
+		return nil, seq < after, nil
+	}
+
+	entries, err := c.rdb.LRange(c.ctx, fmt.Sprintf("replay:%s", clientID), 0, -1).Result()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var messages []types.SSEMessage
+	oldest := seq + 1
+	for i := len(entries) - 1; i >= 0; i-- {
+		var message types.SSEMessage
+		if err := json.Unmarshal([]byte(entries[i]), &message); err != nil {
+			continue
+		}
+
+		id, err := strconv.ParseInt(message.ID, 10, 64)
+		if err != nil {
+			continue
+		}
+		if id < oldest {
+			oldest = id
+		}
+		if id > after {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages, oldest > after+1, nil
+}
+
+// Invocation status
+func (c *Client) StoreInvocation(record *types.InvocationRecord, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("invocations:%s", record.RequestID)
+	return c.rdb.Set(c.ctx, key, data, ttl).Err()
+}
+
+func (c *Client) GetInvocation(requestID string) (*types.InvocationRecord, error) {
+	key := fmt.Sprintf("invocations:%s", requestID)
+	data, err := c.rdb.Get(c.ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var record types.InvocationRecord
+	err = json.Unmarshal([]byte(data), &record)
+	return &record, err
+}
+
+// Connection tickets
+func (c *Client) StoreTicket(ticketID string, ttl time.Duration) error {
+	key := fmt.Sprintf("tickets:%s", ticketID)
+	return c.rdb.Set(c.ctx, key, "1", ttl).Err()
+}
+
+// RedeemTicket consumes a ticket. It returns false if the ticket was already
+// redeemed or has expired.
+func (c *Client) RedeemTicket(ticketID string) (bool, error) {
+	key := fmt.Sprintf("tickets:%s", ticketID)
+	deleted, err := c.rdb.Del(c.ctx, key).Result()
+	return deleted == 1, err
+}
+
+// Admin API keys, stored in one hash keyed by the SHA-256 of the secret
+func (c *Client) StoreAdminKey(keyHash string, record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return c.rdb.HSet(c.ctx, "admin_keys", keyHash, data).Err()
+}
+
+func (c *Client) GetAdminKey(keyHash string) (string, error) {
+	return c.rdb.HGet(c.ctx, "admin_keys", keyHash).Result()
+}
+
+func (c *Client) GetAllAdminKeys() (map[string]string, error) {
+	return c.rdb.HGetAll(c.ctx, "admin_keys").Result()
+}
+
+func (c *Client) DeleteAdminKey(keyHash string) error {
+	return c.rdb.HDel(c.ctx, "admin_keys", keyHash).Err()
+}
+
+// Idempotency keys
+func (c *Client) ClaimIdempotencyKey(key string, value []byte, ttl time.Duration) (bool, error) {
+	return c.rdb.SetNX(c.ctx, "idempotency:"+key, value, ttl).Result()
+}
+
+func (c *Client) GetIdempotencyKey(key string) (string, error) {
+	return c.rdb.Get(c.ctx, "idempotency:"+key).Result()
+}
+
+func (c *Client) StoreIdempotencyKey(key string, value []byte, ttl time.Duration) error {
+	return c.rdb.Set(c.ctx, "idempotency:"+key, value, ttl).Err()
+}
+
+// releaseIdempotencyKeyScript deletes a pending Idempotency-Key claim only
+// if it is still held by the given owner. A claim that expired and was taken
+// by another request, or that has a stored response, is left alone.
+var releaseIdempotencyKeyScript = redis.NewScript(`
+local stored = redis.call('GET', KEYS[1])
+if not stored then
+  return 0
+end
+local claim = cjson.decode(stored)
+if claim['completed'] or claim['owner'] ~= ARGV[1] then
+  return 0
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// ReleaseIdempotencyKey deletes a pending claim held by owner. It reports
+// whether the claim was deleted.
+func (c *Client) ReleaseIdempotencyKey(key, owner string) (bool, error) {
+	released, err := releaseIdempotencyKeyScript.Run(c.ctx, c.rdb, []string{"idempotency:" + key}, owner).Int()
+	return released == 1, err
+}
+
+// RateBucket is a token bucket refilled at Rate tokens per second up to Burst
+type RateBucket struct {
+	Key   string
+	Rate  float64
+	Burst int
+}
+
+// takeTokensScript refills every bucket and takes one token from each, but
+// only if all of them have a token left. It returns the 1-based index of the
+// first empty bucket (0 if allowed), the milliseconds until it refills, and
+// the tokens left in each bucket.
+var takeTokensScript = redis.NewScript(`
+local now = redis.call('TIME')
+local nowms = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local tokens = {}
+local denied = 0
+local retry = 0
+for i = 1, #KEYS do
+	local rate = tonumber(ARGV[2 * i - 1]) / 1000
+	local burst = tonumber(ARGV[2 * i])
+	local state = redis.call('HMGET', KEYS[i], 'tokens', 'ts')
+	local t = tonumber(state[1])
+	local ts = tonumber(state[2])
+	if t == nil or ts == nil then
+		t = burst
+		ts = nowms
+	end
+	t = math.min(burst, t + math.max(0, nowms - ts) * rate)
+	tokens[i] = t
+	if t < 1 and denied == 0 then
+		denied = i
+		retry = math.ceil((1 - t) / rate)
+	end
+end
+local result = {denied, retry}
+for i = 1, #KEYS do
+	local rate = tonumber(ARGV[2 * i - 1]) / 1000
+	local burst = tonumber(ARGV[2 * i])
+	if denied == 0 then
+		tokens[i] = tokens[i] - 1
+	end
+	redis.call('HSET', KEYS[i], 'tokens', tostring(tokens[i]), 'ts', nowms)
+	redis.call('PEXPIRE', KEYS[i], math.ceil(burst / rate) + 1000)
+	table.insert(result, math.floor(tokens[i]))
+end
+return result
+`)
+
+// TakeTokens atomically takes one token from every bucket. denied is the
+// index of the bucket that ran out, or -1 if the tokens were taken.
+func (c *Client) TakeTokens(buckets []RateBucket) (denied int, retryAfter time.Duration, remaining []int64, err error) {
+	keys := make([]string, len(buckets))
+	args := make([]interface{}, 0, 2*len(buckets))
+	for i, bucket := range buckets {
+		keys[i] = bucket.Key
+		args = append(args, bucket.Rate, bucket.Burst)
+	}
+
+	values, err := takeTokensScript.Run(c.ctx, c.rdb, keys, args...).Int64Slice()
+	if err != nil {
+		return -1, 0, nil, err
+	}
+
+	return int(values[0]) - 1, time.Duration(values[1]) * time.Millisecond, values[2:], nil
+}
+
+// breakerAllowScript decides whether a call may go through a circuit. An
+// open circuit turns half-open after the open timeout and then lets a
+// limited number of probes through. Probes that never report back are
+// released after another open timeout.
+var breakerAllowScript = redis.NewScript(`
+local now = redis.call('TIME')
+local nowms = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local timeout = tonumber(ARGV[1])
+local maxProbes = tonumber(ARGV[2])
+local s = redis.call('HMGET', KEYS[1], 'state', 'opened_at', 'probes')
+local state = s[1] or 'closed'
+local since = tonumber(s[2]) or 0
+local probes = tonumber(s[3]) or 0
+if state == 'open' then
+	local wait = since + timeout - nowms
+	if wait > 0 then
+		return {0, 'open', wait}
+	end
+	state = 'half_open'
+	since = nowms
+	probes = 0
+	redis.call('HSET', KEYS[1], 'state', state, 'opened_at', since, 'probes', 0)
+end
+if state == 'half_open' then
+	if probes >= maxProbes then
+		if nowms - since < timeout then
+			return {0, 'half_open', since + timeout - nowms}
+		end
+		redis.call('HSET', KEYS[1], 'opened_at', nowms, 'probes', 0)
+	end
+	redis.call('HINCRBY', KEYS[1], 'probes', 1)
+	return {1, 'half_open', 0}
+end
+return {1, 'closed', 0}
+`)
+
+// breakerRecordScript records the outcome of a call and trips or resets the
+// circuit. It returns the new state and 1 if the state changed.
+var breakerRecordScript = redis.NewScript(`
+local now = redis.call('TIME')
+local nowms = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local success = ARGV[1] == '1'
+local threshold = tonumber(ARGV[2])
+local errorRate = tonumber(ARGV[3])
+local minRequests = tonumber(ARGV[4])
+local window = tonumber(ARGV[5])
+local s = redis.call('HMGET', KEYS[1], 'state', 'window_start', 'requests', 'failures', 'consecutive')
+local state = s[1] or 'closed'
+if state == 'open' then
+	return {'open', 0}
+end
+if state == 'half_open' then
+	if success then
+		redis.call('DEL', KEYS[1])
+		redis.call('HSET', KEYS[1], 'state', 'closed', 'window_start', nowms, 'requests', 0, 'failures', 0, 'consecutive', 0)
+		return {'closed', 1}
+	end
+	redis.call('HSET', KEYS[1], 'state', 'open', 'opened_at', nowms, 'probes', 0)
+	return {'open', 1}
+end
+local windowStart = tonumber(s[2]) or nowms
+local requests = tonumber(s[3]) or 0
+local failures = tonumber(s[4]) or 0
+local consecutive = tonumber(s[5]) or 0
+if nowms - windowStart >= window then
+	windowStart = nowms
+	requests = 0
+	failures = 0
+end
+requests = requests + 1
+if success then
+	consecutive = 0
+else
+	failures = failures + 1
+	consecutive = consecutive + 1
+end
+local trip = (threshold > 0 and consecutive >= threshold) or
+	(errorRate > 0 and requests >= minRequests and failures / requests >= errorRate)
+if trip then
+	redis.call('HSET', KEYS[1], 'state', 'open', 'opened_at', nowms, 'probes', 0,
+		'window_start', windowStart, 'requests', requests, 'failures', failures, 'consecutive', consecutive)
+	return {'open', 1}
+end
+redis.call('HSET', KEYS[1], 'state', 'closed', 'window_start', windowStart,
+	'requests', requests, 'failures', failures, 'consecutive', consecutive)
+return {'closed', 0}
+`)
+
+// BreakerAllow reports whether a call to the function may proceed and, if
+// not, how long until the circuit lets a probe through
+func (c *Client) BreakerAllow(name string, cfg config.BreakerConfig) (bool, string, time.Duration, error) {
+	values, err := breakerAllowScript.Run(c.ctx, c.rdb, []string{"breaker:" + name},
+		cfg.OpenTimeout.Milliseconds(), cfg.HalfOpenProbes).Slice()
+	if err != nil {
+		return true, "", 0, err
+	}
+
+	allowed, _ := values[0].(int64)
+	state, _ := values[1].(string)
+	wait, _ := values[2].(int64)
+	return allowed == 1, state, time.Duration(wait) * time.Millisecond, nil
+}
+
+// BreakerRecord records a call outcome and returns the circuit's state and
+// whether this call changed it
+func (c *Client) BreakerRecord(name string, success bool, cfg config.BreakerConfig) (string, bool, error) {
+	outcome := 0
+	if success {
+		outcome = 1
+	}
+
+	values, err := breakerRecordScript.Run(c.ctx, c.rdb, []string{"breaker:" + name},
+		outcome, cfg.FailureThreshold, cfg.ErrorRate, cfg.MinRequests, cfg.Window.Milliseconds()).Slice()
+	if err != nil {
+		return "", false, err
+	}
+
+	state, _ := values[0].(string)
+	changed, _ := values[1].(int64)
+	return state, changed == 1, nil
+}
+
+func (c *Client) GetBreakerState(name string) (map[string]string, error) {
+	return c.rdb.HGetAll(c.ctx, "breaker:"+name).Result()
+}
+
+func (c *Client) DeleteBreakerState(name string) error {
+	return c.rdb.Del(c.ctx, "breaker:"+name).Err()
 }
 
 // Metrics and monitoring
@@ -0,0 +1,34 @@
+package registry
+
+import (
+	"path"
+
+	"virtualization-manager/pkg/types"
+)
+
+// validateAccessPolicy rejects policies that could never match as intended
+func validateAccessPolicy(policy *types.AccessPolicy, errs *validationError) {
+	if policy == nil {
+		return
+	}
+
+	switch policy.Visibility {
+	case "":
+		policy.Visibility = types.VisibilityPublic
+	case types.VisibilityPublic, types.VisibilityPrivate:
+	default:
+		errs.add("access.visibility", "must be %q or %q", types.VisibilityPublic, types.VisibilityPrivate)
+	}
+
+	for _, pattern := range policy.ClientIDs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs.add("access.client_ids", "invalid pattern %q", pattern)
+		}
+	}
+
+	for claim := range policy.Claims {
+		if claim == "" {
+			errs.add("access.claims", "claim name is required")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"virtualization-manager/pkg/types"
+)
+
+func (fr *FunctionRegistry) breakerEnabled() bool {
+	return fr.breaker.FailureThreshold > 0 || fr.breaker.ErrorRate > 0
+}
+
+// breakerKey names the circuit of one version of a function. Each version
+// has its own circuit, so a failing canary does not cut off the others.
+func breakerKey(name, version string) string {
+	if version == "" {
+		version = types.DefaultVersion
+	}
+	return name + "/" + version
+}
+
+// AllowInvocation checks the circuit breaker of a function version. While
+// the circuit is open it returns false and the time until a probe will be
+// let through. If Redis is unavailable the call is allowed.
+func (fr *FunctionRegistry) AllowInvocation(name, version string) (bool, time.Duration) {
+	if !fr.breakerEnabled() {
+		return true, 0
+	}
+
+	key := breakerKey(name, version)
+	allowed, _, retryAfter, err := fr.redisClient.BreakerAllow(key, fr.breaker)
+	if err != nil {
+		log.Printf("Circuit breaker check failed for %s: %v", key, err)
+		return true, 0
+	}
+	return allowed, retryAfter
+}
+
+// RecordInvocation feeds the outcome of an upstream call to the circuit
+// breaker of the function version that served it
+func (fr *FunctionRegistry) RecordInvocation(name, version string, success bool) {
+	if !fr.breakerEnabled() {
+		return
+	}
+
+	key := breakerKey(name, version)
+	state, changed, err := fr.redisClient.BreakerRecord(key, success, fr.breaker)
+	if err != nil {
+		log.Printf("Failed to record invocation outcome for %s: %v", key, err)
+		return
+	}
+
+	if changed {
+		log.Printf("Circuit for function %s is now %s", key, state)
+	}
+}
+
+// attachCircuits sets the circuit state of a function copy and of each of
+// its versions. The versions map is copied before it is changed.
+func (fr *FunctionRegistry) attachCircuits(function *types.Function) {
+	function.Circuit = fr.CircuitStatus(function.Name, primaryVersion(function))
+	if len(function.Versions) == 0 {
+		return
+	}
+
+	versions := make(map[string]*types.Function, len(function.Versions))
+	for version, definition := range function.Versions {
+		entry := *definition
+		entry.Circuit = fr.CircuitStatus(function.Name, version)
+		versions[version] = &entry
+	}
+	function.Versions = versions
+}
+
+// deleteCircuits removes the circuit state of every version of a function
+func (fr *FunctionRegistry) deleteCircuits(function *types.Function) {
+	versions := []string{primaryVersion(function)}
+	for version := range function.Versions {
+		versions = append(versions, version)
+	}
+	for _, version := range versions {
+		if err := fr.redisClient.DeleteBreakerState(breakerKey(function.Name, version)); err != nil {
+			log.Printf("Failed to delete circuit state for %s: %v", breakerKey(function.Name, version), err)
+		}
+	}
+}
+
+// CircuitStatus returns the circuit breaker state of a function version
+func (fr *FunctionRegistry) CircuitStatus(name, version string) *types.CircuitStatus {
+	if !fr.breakerEnabled() {
+		return nil
+	}
+
+	fields, err := fr.redisClient.GetBreakerState(breakerKey(name, version))
+	if err != nil {
+		log.Printf("Failed to load circuit state for %s: %v", breakerKey(name, version), err)
+		return nil
+	}
+
+	status := &types.CircuitStatus{State: types.CircuitClosed}
+	if state := fields["state"]; state != "" {
+		status.State = state
+	}
+	status.ConsecutiveFailures, _ = strconv.Atoi(fields["consecutive"])
+	status.WindowRequests, _ = strconv.Atoi(fields["requests"])
+	status.WindowFailures, _ = strconv.Atoi(fields["failures"])
+
+	if status.State != types.CircuitClosed {
+		if openedAt, err := strconv.ParseInt(fields["opened_at"], 10, 64); err == nil {
+			t := time.UnixMilli(openedAt)
+			status.OpenedAt = &t
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,453 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"virtualization-manager/pkg/config"
+	"virtualization-manager/pkg/types"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Conflict policies for a function defined in the files that was registered
+// through the API
+const (
+	ConflictFileWins = "file"
+	ConflictAPIWins  = "api"
+	ConflictReject   = "reject"
+)
+
+// Plan actions
+const (
+	planAdd      = "add"
+	planUpdate   = "update"
+	planRemove   = "remove"
+	planConflict = "conflict"
+)
+
+// maxPlanAttempts bounds how often a plan is made again when another replica
+// changes the same functions while it is applied
+const maxPlanAttempts = 5
+
+// FileSource keeps the registry in line with function definitions in a YAML
+// or JSON file, or a directory of them. Functions it registers are marked
+// with the file source and are removed again when they disappear from the
+// files. Functions registered through the API are left alone unless the
+// files define the same name.
+type FileSource struct {
+	registry *FunctionRegistry
+	path     string
+	interval time.Duration
+	dryRun   bool
+	conflict string
+
+	lastHash  string
+	lastError string
+}
+
+// planStep is one change needed to bring the registry in line with the
+// files
+type planStep struct {
+	action   string
+	name     string
+	function *types.Function
+	detail   string
+}
+
+// definitionFile is one file of function definitions
+type definitionFile struct {
+	path string
+	data []byte
+}
+
+func NewFileSource(fr *FunctionRegistry, cfg config.FunctionsConfig) (*FileSource, error) {
+	switch cfg.ConflictPolicy {
+	case ConflictFileWins, ConflictAPIWins, ConflictReject:
+	default:
+		return nil, fmt.Errorf("FUNCTIONS_CONFLICT_POLICY must be %q, %q or %q", ConflictFileWins, ConflictAPIWins, ConflictReject)
+	}
+
+	return &FileSource{
+		registry: fr,
+		path:     cfg.File,
+		interval: cfg.WatchInterval,
+		dryRun:   cfg.DryRun,
+		conflict: cfg.ConflictPolicy,
+	}, nil
+}
+
+// Start applies the definitions and then watches them for changes. Invalid
+// definitions at startup are an error; later they are logged and leave the
+// registry unchanged. Replicas starting together apply the same files, so a
+// function changed by another replica is not an error: the registry is
+// reloaded and the plan made again.
+func (s *FileSource) Start() error {
+	if err := s.sync(); err != nil {
+		return err
+	}
+	if s.interval > 0 {
+		go s.watch()
+	}
+	return nil
+}
+
+func (s *FileSource) watch() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := s.sync()
+		if err == nil {
+			s.lastError = ""
+			continue
+		}
+		// Report a broken file once rather than on every check
+		if err.Error() != s.lastError {
+			log.Printf("Function definitions in %s not applied: %v", s.path, err)
+			s.lastError = err.Error()
+		}
+	}
+}
+
+// sync applies the definitions if the files changed since they were last
+// applied
+func (s *FileSource) sync() error {
+	files, hash, err := readDefinitionFiles(s.path)
+	if err != nil {
+		return err
+	}
+	if hash == s.lastHash {
+		return nil
+	}
+
+	definitions, err := parseDefinitions(files)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		plan, err := s.plan(definitions)
+		if err != nil {
+			return err
+		}
+		s.logPlan(plan)
+
+		if s.dryRun {
+			break
+		}
+		err = s.apply(plan)
+		if err == nil {
+			break
+		}
+
+		var regErr *registryError
+		if !errors.As(err, &regErr) || regErr.status != http.StatusConflict || attempt == maxPlanAttempts {
+			return err
+		}
+		log.Printf("Function definitions in %s: %v; reloading the registry and planning again", s.path, err)
+		if err := s.registry.resync(true); err != nil {
+			return fmt.Errorf("failed to reload functions from Redis: %v", err)
+		}
+	}
+
+	s.lastHash = hash
+	return nil
+}
+
+// plan compares the definitions with the registry
+func (s *FileSource) plan(definitions map[string]*types.Function) ([]planStep, error) {
+	current := s.registry.listFunctions()
+
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var steps []planStep
+	var rejected []string
+	for _, name := range names {
+		definition := definitions[name]
+		existing, exists := current[name]
+
+		switch {
+		case !exists:
+			steps = append(steps, planStep{action: planAdd, name: name, function: definition})
+		case existing.Source != types.SourceFile:
+			switch s.conflict {
+			case ConflictFileWins:
+				steps = append(steps, planStep{action: planUpdate, name: name, function: definition, detail: "taking over from the API"})
+			case ConflictAPIWins:
+				steps = append(steps, planStep{action: planConflict, name: name, detail: "registered through the API, keeping it"})
+			case ConflictReject:
+				rejected = append(rejected, name)
+			}
+		default:
+			if changed := changedFields(existing, definition); len(changed) > 0 {
+				steps = append(steps, planStep{action: planUpdate, name: name, function: definition, detail: strings.Join(changed, ", ")})
+			}
+		}
+	}
+
+	if len(rejected) > 0 {
+		return nil, fmt.Errorf("%s already registered through the API (FUNCTIONS_CONFLICT_POLICY=%s)", strings.Join(rejected, ", "), ConflictReject)
+	}
+
+	removed := make([]string, 0)
+	for name, existing := range current {
+		if _, defined := definitions[name]; !defined && existing.Source == types.SourceFile {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		steps = append(steps, planStep{action: planRemove, name: name})
+	}
+
+	return steps, nil
+}
+
+func (s *FileSource) logPlan(plan []planStep) {
+	counts := make(map[string]int)
+	for _, step := range plan {
+		counts[step.action]++
+	}
+
+	mode := ""
+	if s.dryRun {
+		mode = " (dry run, not applied)"
+	}
+	log.Printf("Function definitions in %s: %d to add, %d to update, %d to remove, %d conflicts%s",
+		s.path, counts[planAdd], counts[planUpdate], counts[planRemove], counts[planConflict], mode)
+
+	symbols := map[string]string{planAdd: "+", planUpdate: "~", planRemove: "-", planConflict: "!"}
+	for _, step := range plan {
+		if step.detail != "" {
+			log.Printf("  %s %s: %s", symbols[step.action], step.name, step.detail)
+		} else {
+			log.Printf("  %s %s", symbols[step.action], step.name)
+		}
+	}
+}
+
+func (s *FileSource) apply(plan []planStep) error {
+	for _, step := range plan {
+		var err error
+		switch step.action {
+		case planAdd, planUpdate:
+			err = s.registry.saveFunction(step.function, types.SourceFile)
+		case planRemove:
+			err = s.registry.RemoveFunction(step.name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to %s function %s: %w", step.action, step.name, err)
+		}
+	}
+	return nil
+}
+
+// changedFields lists the definition fields that differ between two
+// functions, ignoring state the registry manages itself
+func changedFields(current, definition *types.Function) []string {
+	a, b := definitionFields(current), definitionFields(definition)
+
+	var changed []string
+	for field, value := range b {
+		if !bytes.Equal(a[field], value) {
+			changed = append(changed, field)
+		}
+	}
+	for field := range a {
+		if _, exists := b[field]; !exists {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func definitionFields(function *types.Function) map[string]json.RawMessage {
+	definition := *function
+	definition.Versions = nil
+	definition.Traffic = nil
+	definition.Revision = 0
+	definition.Generation = 0
+	definition.Aliases = nil
+	definition.Circuit = nil
+	definition.IsActive = false
+	definition.Disabled = false
+	definition.Source = ""
+	definition.CreatedAt = time.Time{}
+	definition.UpdatedAt = time.Time{}
+
+	definition.Endpoints = make([]types.Endpoint, len(function.Endpoints))
+	for i, endpoint := range function.Endpoints {
+		endpoint.Healthy = true
+		endpoint.LastHealthCheck = time.Time{}
+		definition.Endpoints[i] = endpoint
+	}
+
+	data, _ := json.Marshal(&definition)
+	var fields map[string]json.RawMessage
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// readDefinitionFiles reads a definition file, or every .yaml, .yml and
+// .json file below a directory. Hidden entries are skipped, which also skips
+// the timestamped directories Kubernetes uses for mounted ConfigMaps.
+func readDefinitionFiles(root string) ([]definitionFile, string, error) {
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path == root && !entry.IsDir() {
+			paths = append(paths, path)
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+			if !entry.IsDir() {
+				paths = append(paths, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := sha256.New()
+	files := make([]definitionFile, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+		hash.Write([]byte(path))
+		hash.Write([]byte{0})
+		hash.Write(data)
+		files = append(files, definitionFile{path: path, data: data})
+	}
+
+	return files, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// parseDefinitions decodes and validates the functions in every file. A
+// file holds a list of functions, an object with a "functions" list, or a
+// single function.
+func parseDefinitions(files []definitionFile) (map[string]*types.Function, error) {
+	definitions := make(map[string]*types.Function)
+	defined := make(map[string]string)
+
+	for _, file := range files {
+		data := file.data
+		if filepath.Ext(file.path) != ".json" {
+			var err error
+			if data, err = yamlToJSON(data); err != nil {
+				return nil, fmt.Errorf("%s: %v", file.path, err)
+			}
+		}
+
+		raw, err := splitDefinitions(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file.path, err)
+		}
+
+		for i, entry := range raw {
+			var function types.Function
+			err := decodeDefinitionBytes(entry, &function)
+			if err == nil {
+				err = validateFunction(&function)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: function %d (%s): %v", file.path, i+1, function.Name, err)
+			}
+
+			if previous, exists := defined[function.Name]; exists {
+				return nil, fmt.Errorf("%s: function %s is already defined in %s", file.path, function.Name, previous)
+			}
+			defined[function.Name] = file.path
+			definitions[function.Name] = &function
+		}
+	}
+
+	return definitions, nil
+}
+
+func splitDefinitions(data []byte) ([]json.RawMessage, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+
+	var list []json.RawMessage
+	if data[0] == '[' {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	if functions, exists := object["functions"]; exists {
+		if err := json.Unmarshal(functions, &list); err != nil {
+			return nil, fmt.Errorf("functions must be a list")
+		}
+		return list, nil
+	}
+	return []json.RawMessage{data}, nil
+}
+
+// yamlToJSON converts YAML to JSON so definitions in either format go
+// through the same strict decoding
+func yamlToJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(convertYAML(value))
+}
+
+// convertYAML turns the map[interface{}]interface{} values yaml.v2 produces
+// into maps JSON can encode
+func convertYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = convertYAML(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range v {
+			v[i] = convertYAML(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
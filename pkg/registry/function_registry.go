@@ -8,24 +8,50 @@ import (
 	"sync"
 	"time"
 
+	"virtualization-manager/pkg/auth"
+	"virtualization-manager/pkg/config"
 	"virtualization-manager/pkg/redis"
 	"virtualization-manager/pkg/types"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
 )
 
 type FunctionRegistry struct {
 	redisClient *redis.Client
 	functions   map[string]*types.Function
 	mutex       sync.RWMutex
+	breaker     config.BreakerConfig
+
+	// Replicas share changes over pub/sub and resync from Redis periodically
+	nodeID           string
+	pubsub           *goredis.PubSub
+	resyncInterval   time.Duration
+	syncedGeneration int64
+	resyncs          uint64
+
+	// Revisions are immutable, so loaded ones are cached for good
+	revisions     map[string]*types.Function
+	revisionMutex sync.RWMutex
 }
 
-func NewFunctionRegistry(redisClient *redis.Client) *FunctionRegistry {
+func NewFunctionRegistry(redisClient *redis.Client, cfg *config.Config) *FunctionRegistry {
 	fr := &FunctionRegistry{
 		redisClient: redisClient,
 		functions:   make(map[string]*types.Function),
+		breaker:     cfg.Breaker,
+		revisions:   make(map[string]*types.Function),
+
+		nodeID:         cfg.Server.NodeID,
+		pubsub:         redisClient.Subscribe(registryChannel),
+		resyncInterval: cfg.Registry.ResyncInterval,
 	}
 
-	// Load existing functions from Redis
+	// Load existing functions from Redis. Changes published meanwhile are
+	// applied once loading is done.
 	fr.loadFunctionsFromRedis()
+	go fr.startSubscriber()
+	go fr.startResync()
 
 	// Start health checking
 	go fr.startHealthCheck()
@@ -36,30 +62,240 @@ func NewFunctionRegistry(redisClient *redis.Client) *FunctionRegistry {
 // RegisterFunction registers a new serverless function
 func (fr *FunctionRegistry) RegisterFunction(w http.ResponseWriter, r *http.Request) {
 	var function types.Function
-	if err := json.NewDecoder(r.Body).Decode(&function); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if err := decodeDefinition(r.Body, &function); err != nil {
+		writeRegistryError(w, err)
 		return
 	}
 
-	// Set default values
-	if function.Method == "" {
-		function.Method = "POST"
+	if err := fr.saveFunction(&function, types.SourceAPI); err != nil {
+		writeRegistryError(w, err)
+		return
 	}
-	if function.Timeout == 0 {
-		function.Timeout = 30 * time.Second
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(function)
+}
+
+// saveFunction validates a definition and stores it as the function's latest
+// revision. Versions, the traffic split, aliases, the disabled flag and the
+// creation time are managed separately and carry over from the definition
+// it replaces.
+func (fr *FunctionRegistry) saveFunction(function *types.Function, source string) error {
+	if err := validateFunction(function); err != nil {
+		return err
 	}
+	function.Source = source
 
 	function.IsActive = true
 	function.CreatedAt = time.Now()
-	function.UpdatedAt = time.Now()
+	function.UpdatedAt = function.CreatedAt
+	function.Versions = nil
+	function.Traffic = nil
+	function.Aliases = nil
+	function.Circuit = nil
+	function.Disabled = false
+
+	revision, err := fr.redisClient.NextFunctionRevision(function.Name)
+	if err != nil {
+		return fmt.Errorf("failed to allocate revision: %v", err)
+	}
+	function.Revision = int(revision)
 
-	if err := fr.AddFunction(&function); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	fr.mutex.Lock()
+	existing := fr.functions[function.Name]
+	if existing != nil {
+		function.Versions = existing.Versions
+		function.Traffic = existing.Traffic
+		function.Aliases = existing.Aliases
+		function.Disabled = existing.Disabled
+		function.CreatedAt = existing.CreatedAt
+	}
+	errs := &validationError{}
+	restoreRedactedHeaders(function, existing, errs)
+	err = errs.result()
+	if err == nil {
+		err = fr.storeLocked(function)
+	}
+	fr.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("Registered function: %s at %s", function.Name, function.Endpoint)
+
+	// Every registration is kept as an immutable revision. It is only
+	// written once the registration is stored, so a conflict leaves no
+	// revision behind; the skipped number is not reused. The registration
+	// itself succeeded, so a failure here is only logged.
+	if err := fr.storeRevision(function); err != nil {
+		log.Printf("Function %s was stored without its revision %d: %v", function.Name, function.Revision, err)
+	}
+	return nil
+}
+
+// DescribeFunction returns one function. Private functions are only visible
+// to admins.
+func (fr *FunctionRegistry) DescribeFunction(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	function, err := fr.GetFunction(name)
+	if err != nil || !fr.visibleTo(r, function) {
+		http.Error(w, fmt.Sprintf("function %s not found", name), http.StatusNotFound)
 		return
 	}
 
+	fr.writeFunction(w, r, function)
+}
+
+// ReplaceFunction replaces the definition of an existing function
+func (fr *FunctionRegistry) ReplaceFunction(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if _, err := fr.GetFunction(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var function types.Function
+	if err := decodeDefinition(r.Body, &function); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+	if function.Name != "" && function.Name != name {
+		errs := &validationError{}
+		errs.add("name", "must match the function name in the path")
+		writeRegistryError(w, errs)
+		return
+	}
+	function.Name = name
+
+	if err := fr.saveFunction(&function, types.SourceAPI); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	fr.writeFunction(w, r, &function)
+}
+
+// PatchFunction applies a JSON merge patch (RFC 7396) to a function's
+// definition: fields in the body replace the current values, nested objects
+// are merged and null removes a field
+func (fr *FunctionRegistry) PatchFunction(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	current, err := fr.GetFunction(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var patch map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if patched, exists := patch["name"]; exists && patched != name {
+		errs := &validationError{}
+		errs.add("name", "cannot be changed")
+		writeRegistryError(w, errs)
+		return
+	}
+
+	var definition map[string]interface{}
+	encoded, _ := json.Marshal(current)
+	json.Unmarshal(encoded, &definition)
+	merged, _ := json.Marshal(mergePatch(definition, patch))
+
+	var function types.Function
+	if err := decodeDefinitionBytes(merged, &function); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+	if err := fr.saveFunction(&function, types.SourceAPI); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	fr.writeFunction(w, r, &function)
+}
+
+// mergePatch applies a JSON merge patch to a decoded JSON object
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = make(map[string]interface{})
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			existing, _ := target[key].(map[string]interface{})
+			target[key] = mergePatch(existing, nested)
+			continue
+		}
+		target[key] = value
+	}
+	return target
+}
+
+// DeleteFunction removes a function. Its revision history is kept, so
+// registering the name again continues the revision numbers.
+func (fr *FunctionRegistry) DeleteFunction(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if err := fr.RemoveFunction(name); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EnableFunction allows invocations of a disabled function again
+func (fr *FunctionRegistry) EnableFunction(w http.ResponseWriter, r *http.Request) {
+	fr.setDisabled(w, r, false)
+}
+
+// DisableFunction rejects invocations of a function until it is enabled.
+// Unlike the active flag, which follows health checks, it only changes
+// through the admin API.
+func (fr *FunctionRegistry) DisableFunction(w http.ResponseWriter, r *http.Request) {
+	fr.setDisabled(w, r, true)
+}
+
+func (fr *FunctionRegistry) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	name := mux.Vars(r)["name"]
+
+	updated, err := fr.updateFunction(name, func(function *types.Function) error {
+		function.Disabled = disabled
+		return nil
+	})
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	log.Printf("Set function %s disabled to %v", name, disabled)
+	fr.writeFunction(w, r, updated)
+}
+
+// visibleTo reports whether the caller may see a function
+func (fr *FunctionRegistry) visibleTo(r *http.Request, function *types.Function) bool {
+	private := function.Access != nil && function.Access.Visibility == types.VisibilityPrivate
+	return !private || auth.HasRole(r.Context(), auth.RoleAdmin)
+}
+
+// writeFunction sends a copy of a function with its circuit state, with
+// header values redacted for non-admins
+func (fr *FunctionRegistry) writeFunction(w http.ResponseWriter, r *http.Request, function *types.Function) {
+	entry := *function
+	if !auth.HasRole(r.Context(), auth.RoleAdmin) {
+		redactHeaders(&entry)
+	}
+	fr.attachCircuits(&entry)
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(function)
+	json.NewEncoder(w).Encode(&entry)
 }
 
 // AddFunction adds a function to the registry
@@ -67,11 +303,8 @@ func (fr *FunctionRegistry) AddFunction(function *types.Function) error {
 	fr.mutex.Lock()
 	defer fr.mutex.Unlock()
 
-	fr.functions[function.Name] = function
-
-	// Store in Redis
-	if err := fr.redisClient.StoreFunction(function); err != nil {
-		return fmt.Errorf("failed to store function in Redis: %v", err)
+	if err := fr.storeLocked(function); err != nil {
+		return err
 	}
 
 	log.Printf("Registered function: %s at %s", function.Name, function.Endpoint)
@@ -92,13 +325,28 @@ func (fr *FunctionRegistry) GetFunction(name string) (*types.Function, error) {
 
 // GetFunctions returns all registered functions
 func (fr *FunctionRegistry) GetFunctions(w http.ResponseWriter, r *http.Request) {
+	// Function headers often carry upstream credentials and private functions
+	// are not advertised, so only admins see either
+	isAdmin := auth.HasRole(r.Context(), auth.RoleAdmin)
+
 	fr.mutex.RLock()
 	functions := make([]*types.Function, 0, len(fr.functions))
 	for _, fn := range fr.functions {
-		functions = append(functions, fn)
+		if !isAdmin && fn.Access != nil && fn.Access.Visibility == types.VisibilityPrivate {
+			continue
+		}
+		entry := *fn
+		if !isAdmin {
+			redactHeaders(&entry)
+		}
+		functions = append(functions, &entry)
 	}
 	fr.mutex.RUnlock()
 
+	for _, fn := range functions {
+		fr.attachCircuits(fn)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"functions": functions,
@@ -106,21 +354,63 @@ func (fr *FunctionRegistry) GetFunctions(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// redactedValue replaces header values shown to non-admins
+const redactedValue = "[redacted]"
+
+// redactHeaders masks the header values of a function copy and its versions
+func redactHeaders(function *types.Function) {
+	if len(function.Headers) > 0 {
+		redacted := make(map[string]string, len(function.Headers))
+		for name := range function.Headers {
+			redacted[name] = redactedValue
+		}
+		function.Headers = redacted
+	}
+
+	if len(function.Versions) > 0 {
+		versions := make(map[string]*types.Function, len(function.Versions))
+		for version, definition := range function.Versions {
+			copied := *definition
+			redactHeaders(&copied)
+			versions[version] = &copied
+		}
+		function.Versions = versions
+	}
+}
+
+// restoreRedactedHeaders puts back the stored value of every header sent as
+// the redacted placeholder, so a definition read by a non-admin can be sent
+// back without overwriting credentials the caller never saw. The
+// placeholder is rejected for headers without a stored value.
+func restoreRedactedHeaders(function, existing *types.Function, errs *validationError) {
+	for name, value := range function.Headers {
+		if value != redactedValue {
+			continue
+		}
+		if existing != nil {
+			if stored, exists := existing.Headers[name]; exists {
+				function.Headers[name] = stored
+				continue
+			}
+		}
+		errs.add("headers."+name, "must be set to the header value, not %s", redactedValue)
+	}
+}
+
 // RemoveFunction removes a function from the registry
 func (fr *FunctionRegistry) RemoveFunction(name string) error {
 	fr.mutex.Lock()
 	defer fr.mutex.Unlock()
 
-	if _, exists := fr.functions[name]; !exists {
-		return fmt.Errorf("function %s not found", name)
+	current, exists := fr.functions[name]
+	if !exists {
+		return &registryError{http.StatusNotFound, fmt.Sprintf("function %s not found", name)}
 	}
 
-	delete(fr.functions, name)
-
-	// Remove from Redis
-	if err := fr.redisClient.DeleteFunction(name); err != nil {
-		return fmt.Errorf("failed to delete function from Redis: %v", err)
+	if err := fr.deleteLocked(current); err != nil {
+		return err
 	}
+	fr.deleteCircuits(current)
 
 	log.Printf("Removed function: %s", name)
 	return nil
@@ -128,26 +418,30 @@ func (fr *FunctionRegistry) RemoveFunction(name string) error {
 
 // UpdateFunctionStatus updates the active status of a function
 func (fr *FunctionRegistry) UpdateFunctionStatus(name string, isActive bool) error {
-	fr.mutex.Lock()
-	defer fr.mutex.Unlock()
-
-	function, exists := fr.functions[name]
-	if !exists {
-		return fmt.Errorf("function %s not found", name)
-	}
-
-	function.IsActive = isActive
-	function.UpdatedAt = time.Now()
-
-	// Update in Redis
-	if err := fr.redisClient.StoreFunction(function); err != nil {
-		return fmt.Errorf("failed to update function in Redis: %v", err)
+	_, err := fr.updateFunction(name, func(function *types.Function) error {
+		function.IsActive = isActive
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	log.Printf("Updated function %s status to %v", name, isActive)
 	return nil
 }
 
+// listFunctions returns a copy of the registry's functions by name
+func (fr *FunctionRegistry) listFunctions() map[string]*types.Function {
+	fr.mutex.RLock()
+	defer fr.mutex.RUnlock()
+
+	functions := make(map[string]*types.Function, len(fr.functions))
+	for name, function := range fr.functions {
+		functions[name] = function
+	}
+	return functions
+}
+
 // GetActiveFunctions returns only active functions
 func (fr *FunctionRegistry) GetActiveFunctions() map[string]*types.Function {
 	fr.mutex.RLock()
@@ -155,7 +449,7 @@ func (fr *FunctionRegistry) GetActiveFunctions() map[string]*types.Function {
 
 	activeFunctions := make(map[string]*types.Function)
 	for name, function := range fr.functions {
-		if function.IsActive {
+		if function.IsActive && !function.Disabled {
 			activeFunctions[name] = function
 		}
 	}
@@ -165,20 +459,14 @@ func (fr *FunctionRegistry) GetActiveFunctions() map[string]*types.Function {
 
 // loadFunctionsFromRedis loads functions from Redis on startup
 func (fr *FunctionRegistry) loadFunctionsFromRedis() {
-	functions, err := fr.redisClient.GetAllFunctions()
-	if err != nil {
+	if err := fr.resync(true); err != nil {
 		log.Printf("Failed to load functions from Redis: %v", err)
 		return
 	}
 
-	fr.mutex.Lock()
-	defer fr.mutex.Unlock()
-
-	for _, function := range functions {
-		fr.functions[function.Name] = function
-	}
-
-	log.Printf("Loaded %d functions from Redis", len(functions))
+	fr.mutex.RLock()
+	defer fr.mutex.RUnlock()
+	log.Printf("Loaded %d functions from Redis", len(fr.functions))
 }
 
 // startHealthCheck performs periodic health checks on registered functions
@@ -192,23 +480,66 @@ func (fr *FunctionRegistry) startHealthCheck() {
 }
 
 func (fr *FunctionRegistry) performHealthCheck() {
-	activeFunctions := fr.GetActiveFunctions()
+	functions := fr.listFunctions()
 
-	for name, function := range activeFunctions {
+	// Inactive functions are checked too so they can come back online
+	for name, function := range functions {
 		go fr.checkFunctionHealth(name, function)
 	}
 }
 
+// checkFunctionHealth probes the endpoints of every version of a function.
+// Each version's unhealthy endpoints are taken out of rotation separately.
 func (fr *FunctionRegistry) checkFunctionHealth(name string, function *types.Function) {
+	results := map[string]map[string]bool{
+		primaryVersion(function): probeDefinition(name, function),
+	}
+	for version, definition := range function.Versions {
+		results[version] = probeDefinition(name+" version "+version, definition)
+	}
+
+	if err := fr.UpdateHealth(name, results); err != nil {
+		log.Printf("Failed to update health of %s: %v", name, err)
+	}
+}
+
+// probeDefinition probes the endpoints of one version of a function and
+// returns whether each one is healthy
+func probeDefinition(label string, definition *types.Function) map[string]bool {
+	if len(definition.Endpoints) == 0 {
+		err := probeEndpoint(definition, definition.Endpoint)
+		if err != nil && definition.IsActive {
+			log.Printf("Health check failed for function %s: %v", label, err)
+		} else if err == nil && !definition.IsActive {
+			log.Printf("Function %s is back online", label)
+		}
+		return map[string]bool{definition.Endpoint: err == nil}
+	}
+
+	healthy := make(map[string]bool, len(definition.Endpoints))
+	for _, endpoint := range definition.Endpoints {
+		err := probeEndpoint(definition, endpoint.URL)
+		healthy[endpoint.URL] = err == nil
+
+		if err != nil && endpoint.Healthy {
+			log.Printf("Endpoint %s of function %s is unhealthy: %v", endpoint.URL, label, err)
+		} else if err == nil && !endpoint.Healthy {
+			log.Printf("Endpoint %s of function %s is back in rotation", endpoint.URL, label)
+		}
+	}
+	return healthy
+}
+
+// probeEndpoint sends a health check request to an endpoint
+func probeEndpoint(function *types.Function, endpoint string) error {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 
 	// Create a simple health check request
-	req, err := http.NewRequest("GET", function.Endpoint+"/health", nil)
+	req, err := http.NewRequest("GET", endpoint+"/health", nil)
 	if err != nil {
-		log.Printf("Failed to create health check request for %s: %v", name, err)
-		return
+		return fmt.Errorf("failed to create health check request: %v", err)
 	}
 
 	// Add custom headers if any
@@ -218,41 +549,192 @@ func (fr *FunctionRegistry) checkFunctionHealth(name string, function *types.Fun
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Health check failed for function %s: %v", name, err)
-		fr.UpdateFunctionStatus(name, false)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		// Function is healthy
-		if !function.IsActive {
-			log.Printf("Function %s is back online", name)
-			fr.UpdateFunctionStatus(name, true)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unhealthy status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// registryError is a rejected registry change with the HTTP status to report
+type registryError struct {
+	status  int
+	message string
+}
+
+func (e *registryError) Error() string {
+	return e.message
+}
+
+// writeRegistryError reports a failed registry change to an HTTP caller
+func writeRegistryError(w http.ResponseWriter, err error) {
+	if valErr, ok := err.(*validationError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "invalid function definition",
+			"fields": valErr.fields,
+		})
+		return
+	}
+	if regErr, ok := err.(*registryError); ok {
+		http.Error(w, regErr.message, regErr.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// updateFunction applies change to a copy of a function and stores the copy.
+// Functions are replaced rather than modified so in-flight invocations keep
+// a consistent view of them; change must copy any map it modifies.
+func (fr *FunctionRegistry) updateFunction(name string, change func(*types.Function) error) (*types.Function, error) {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+
+	current, exists := fr.functions[name]
+	if !exists {
+		return nil, &registryError{http.StatusNotFound, fmt.Sprintf("function %s not found", name)}
+	}
+
+	updated := *current
+	if err := change(&updated); err != nil {
+		return nil, err
+	}
+	updated.UpdatedAt = time.Now()
+
+	if err := fr.storeLocked(&updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// UpdateHealth records health check results by version and endpoint URL,
+// and derives whether each version is active. The function is active while
+// its primary version is. The function is replaced rather than modified so
+// in-flight invocations keep a consistent view of it. Only changes in
+// health are stored and shared with the other replicas; check times alone
+// stay local.
+func (fr *FunctionRegistry) UpdateHealth(name string, results map[string]map[string]bool) error {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+
+	current, exists := fr.functions[name]
+	if !exists {
+		return fmt.Errorf("function %s not found", name)
+	}
+
+	now := time.Now()
+	updated := *current
+	changed := applyHealth(&updated, results[primaryVersion(current)], now)
+	if updated.IsActive != current.IsActive {
+		log.Printf("Updated function %s status to %v", name, updated.IsActive)
+	}
+
+	if len(current.Versions) > 0 {
+		updated.Versions = copyVersions(current.Versions)
+		for version, definition := range current.Versions {
+			if healthy, checked := results[version]; checked {
+				copied := *definition
+				changed = applyHealth(&copied, healthy, now) || changed
+				updated.Versions[version] = &copied
+			}
+		}
+	}
+
+	if !changed {
+		fr.functions[name] = &updated
+		return nil
+	}
+
+	updated.UpdatedAt = now
+	return fr.storeLocked(&updated)
+}
+
+// applyHealth records health check results on a copy of one version of a
+// function and reports whether its health changed. A version with several
+// endpoints is active while any of them is healthy.
+func applyHealth(definition *types.Function, healthy map[string]bool, now time.Time) bool {
+	if healthy == nil {
+		return false
+	}
+
+	if len(definition.Endpoints) == 0 {
+		result, checked := healthy[definition.Endpoint]
+		if !checked || result == definition.IsActive {
+			return false
+		}
+		definition.IsActive = result
+		return true
+	}
+
+	endpoints := make([]types.Endpoint, len(definition.Endpoints))
+	anyHealthy := false
+	changed := false
+	for i, endpoint := range definition.Endpoints {
+		if result, checked := healthy[endpoint.URL]; checked {
+			changed = changed || endpoint.Healthy != result
+			endpoint.Healthy = result
+			endpoint.LastHealthCheck = now
 		}
-	} else {
-		log.Printf("Function %s returned unhealthy status: %d", name, resp.StatusCode)
-		fr.UpdateFunctionStatus(name, false)
+		anyHealthy = anyHealthy || endpoint.Healthy
+		endpoints[i] = endpoint
 	}
+	definition.Endpoints = endpoints
+
+	changed = changed || anyHealthy != definition.IsActive
+	definition.IsActive = anyHealthy
+	return changed
 }
 
 // GetStats returns registry statistics
 func (fr *FunctionRegistry) GetStats() map[string]interface{} {
 	fr.mutex.RLock()
-	defer fr.mutex.RUnlock()
-
 	totalFunctions := len(fr.functions)
 	activeFunctions := 0
+	disabledFunctions := 0
+	circuitKeys := make([][2]string, 0, len(fr.functions))
 
-	for _, function := range fr.functions {
+	for name, function := range fr.functions {
 		if function.IsActive {
 			activeFunctions++
 		}
+		if function.Disabled {
+			disabledFunctions++
+		}
+		circuitKeys = append(circuitKeys, [2]string{name, primaryVersion(function)})
+		for version := range function.Versions {
+			circuitKeys = append(circuitKeys, [2]string{name, version})
+		}
 	}
+	syncedGeneration, resyncs := fr.syncedGeneration, fr.resyncs
+	fr.mutex.RUnlock()
 
-	return map[string]interface{}{
-		"total_functions":  totalFunctions,
-		"active_functions": activeFunctions,
+	stats := map[string]interface{}{
+		"total_functions":    totalFunctions,
+		"active_functions":   activeFunctions,
 		"inactive_functions": totalFunctions - activeFunctions,
+		"disabled_functions": disabledFunctions,
+		"synced_generation":  syncedGeneration,
+		"resyncs":            resyncs,
+	}
+
+	if fr.breakerEnabled() {
+		circuits := make(map[string]string, len(circuitKeys))
+		openCircuits := 0
+		for _, key := range circuitKeys {
+			if status := fr.CircuitStatus(key[0], key[1]); status != nil {
+				circuits[breakerKey(key[0], key[1])] = status.State
+				if status.State != types.CircuitClosed {
+					openCircuits++
+				}
+			}
+		}
+		stats["circuits"] = circuits
+		stats["open_circuits"] = openCircuits
 	}
+
+	return stats
 }
@@ -0,0 +1,240 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"virtualization-manager/pkg/auth"
+	"virtualization-manager/pkg/types"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// SplitFunctionRef splits "name@ref" into the function name and the alias
+// or revision it refers to
+func SplitFunctionRef(ref string) (string, string) {
+	name, target, _ := strings.Cut(ref, "@")
+	return name, target
+}
+
+// storeRevision stores a registration as an immutable revision under the
+// revision number it was stored with
+func (fr *FunctionRegistry) storeRevision(function *types.Function) error {
+	snapshot := *function
+	snapshot.Versions = nil
+	snapshot.Traffic = nil
+	snapshot.Aliases = nil
+	snapshot.Circuit = nil
+	snapshot.Disabled = false
+	snapshot.Generation = 0
+	if err := fr.redisClient.StoreFunctionRevision(&snapshot); err != nil {
+		return fmt.Errorf("failed to store revision: %v", err)
+	}
+
+	log.Printf("Stored revision %d of function %s", function.Revision, function.Name)
+	return nil
+}
+
+// GetRevision loads one revision of a function
+func (fr *FunctionRegistry) GetRevision(name string, revision int) (*types.Function, error) {
+	key := name + "@" + strconv.Itoa(revision)
+
+	fr.revisionMutex.RLock()
+	cached, exists := fr.revisions[key]
+	fr.revisionMutex.RUnlock()
+	if exists {
+		return cached, nil
+	}
+
+	function, err := fr.redisClient.GetFunctionRevision(name, revision)
+	if err == goredis.Nil {
+		return nil, fmt.Errorf("revision %d of %s not found", revision, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fr.revisionMutex.Lock()
+	fr.revisions[key] = function
+	fr.revisionMutex.Unlock()
+	return function, nil
+}
+
+// ResolveRef returns the revision an alias or revision number refers to
+func (fr *FunctionRegistry) ResolveRef(function *types.Function, ref string) (*types.Function, error) {
+	if alias, exists := function.Aliases[ref]; exists {
+		return fr.GetRevision(function.Name, alias.Revision)
+	}
+
+	revision, err := strconv.Atoi(ref)
+	if err != nil || revision <= 0 {
+		return nil, fmt.Errorf("unknown alias %s of %s", ref, function.Name)
+	}
+	if revision == function.Revision {
+		return function, nil
+	}
+	return fr.GetRevision(function.Name, revision)
+}
+
+// GetRevisions lists a function's revisions, newest first, and its aliases
+func (fr *FunctionRegistry) GetRevisions(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	function, err := fr.GetFunction(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	revisions, err := fr.redisClient.GetFunctionRevisions(name)
+	if err != nil {
+		http.Error(w, "Failed to load revisions", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision > revisions[j].Revision
+	})
+
+	if !auth.HasRole(r.Context(), auth.RoleAdmin) {
+		for _, revision := range revisions {
+			redactHeaders(revision)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":             name,
+		"current_revision": function.Revision,
+		"aliases":          function.Aliases,
+		"revisions":        revisions,
+		"count":            len(revisions),
+	})
+}
+
+// AliasRequest is the body of PUT /admin/functions/{name}/aliases/{alias}
+type AliasRequest struct {
+	Revision int `json:"revision"`
+}
+
+// SetAlias points an alias at a revision, remembering where it pointed
+// before
+func (fr *FunctionRegistry) SetAlias(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, aliasName := vars["name"], vars["alias"]
+
+	var request AliasRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if _, err := strconv.Atoi(aliasName); err == nil {
+		http.Error(w, "Alias names must not be numbers", http.StatusBadRequest)
+		return
+	}
+	if _, err := fr.GetRevision(name, request.Revision); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := fr.updateFunction(name, func(function *types.Function) error {
+		function.Aliases = copyAliases(function.Aliases)
+		alias := &types.FunctionAlias{Revision: request.Revision, UpdatedAt: time.Now()}
+		if previous, exists := function.Aliases[aliasName]; exists {
+			if previous.Revision == request.Revision {
+				alias = previous
+			} else {
+				alias.History = append(append([]int{}, previous.History...), previous.Revision)
+			}
+		}
+		function.Aliases[aliasName] = alias
+		return nil
+	})
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	log.Printf("Alias %s of function %s now points to revision %d", aliasName, name, request.Revision)
+	writeAlias(w, name, aliasName, updated.Aliases[aliasName])
+}
+
+// RollbackAlias points an alias back at the revision it pointed to before
+func (fr *FunctionRegistry) RollbackAlias(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, aliasName := vars["name"], vars["alias"]
+
+	updated, err := fr.updateFunction(name, func(function *types.Function) error {
+		previous, exists := function.Aliases[aliasName]
+		if !exists {
+			return &registryError{http.StatusNotFound, fmt.Sprintf("alias %s of %s not found", aliasName, name)}
+		}
+		if len(previous.History) == 0 {
+			return &registryError{http.StatusConflict, fmt.Sprintf("alias %s has no earlier revision", aliasName)}
+		}
+
+		function.Aliases = copyAliases(function.Aliases)
+		last := len(previous.History) - 1
+		function.Aliases[aliasName] = &types.FunctionAlias{
+			Revision:  previous.History[last],
+			History:   append([]int{}, previous.History[:last]...),
+			UpdatedAt: time.Now(),
+		}
+		return nil
+	})
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	alias := updated.Aliases[aliasName]
+	log.Printf("Rolled back alias %s of function %s to revision %d", aliasName, name, alias.Revision)
+	writeAlias(w, name, aliasName, alias)
+}
+
+// DeleteAlias removes an alias
+func (fr *FunctionRegistry) DeleteAlias(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, aliasName := vars["name"], vars["alias"]
+
+	_, err := fr.updateFunction(name, func(function *types.Function) error {
+		if _, exists := function.Aliases[aliasName]; !exists {
+			return &registryError{http.StatusNotFound, fmt.Sprintf("alias %s of %s not found", aliasName, name)}
+		}
+		function.Aliases = copyAliases(function.Aliases)
+		delete(function.Aliases, aliasName)
+		return nil
+	})
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	log.Printf("Deleted alias %s of function %s", aliasName, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeAlias(w http.ResponseWriter, name, aliasName string, alias *types.FunctionAlias) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":       name,
+		"alias":      aliasName,
+		"revision":   alias.Revision,
+		"history":    alias.History,
+		"updated_at": alias.UpdatedAt,
+	})
+}
+
+func copyAliases(aliases map[string]*types.FunctionAlias) map[string]*types.FunctionAlias {
+	copied := make(map[string]*types.FunctionAlias, len(aliases)+1)
+	for name, alias := range aliases {
+		copied[name] = alias
+	}
+	return copied
+}
@@ -0,0 +1,184 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"virtualization-manager/pkg/types"
+
+	goredis "github.com/go-redis/redis/v8"
+)
+
+const registryChannel = "registry:changes"
+
+// registryChange tells the other replicas that a function was stored or
+// deleted. Generation orders changes to the same function, so late or
+// repeated notifications are ignored.
+type registryChange struct {
+	Origin     string          `json:"origin"`
+	Name       string          `json:"name"`
+	Generation int64           `json:"generation"`
+	Deleted    bool            `json:"deleted,omitempty"`
+	Function   *types.Function `json:"function,omitempty"`
+}
+
+// storeLocked numbers a changed function, stores it in Redis and tells the
+// other replicas. The store fails with a conflict if another replica changed
+// the function since the local copy was loaded. fr.mutex must be held.
+func (fr *FunctionRegistry) storeLocked(function *types.Function) error {
+	var expected int64
+	if current, exists := fr.functions[function.Name]; exists {
+		expected = current.Generation
+	}
+
+	generation, err := fr.redisClient.NextFunctionGeneration()
+	if err != nil {
+		return fmt.Errorf("failed to store function in Redis: %v", err)
+	}
+	function.Generation = generation
+
+	stored, err := fr.redisClient.StoreFunction(function, expected)
+	if err != nil {
+		return fmt.Errorf("failed to store function in Redis: %v", err)
+	}
+	if !stored {
+		return &registryError{http.StatusConflict, fmt.Sprintf("function %s was changed on another node, retry", function.Name)}
+	}
+
+	fr.functions[function.Name] = function
+	fr.publishChange(registryChange{Name: function.Name, Generation: generation, Function: function})
+	return nil
+}
+
+// deleteLocked deletes a function from Redis and tells the other replicas.
+// fr.mutex must be held.
+func (fr *FunctionRegistry) deleteLocked(current *types.Function) error {
+	generation, err := fr.redisClient.NextFunctionGeneration()
+	if err != nil {
+		return fmt.Errorf("failed to delete function from Redis: %v", err)
+	}
+
+	deleted, err := fr.redisClient.DeleteFunction(current.Name, current.Generation)
+	if err != nil {
+		return fmt.Errorf("failed to delete function from Redis: %v", err)
+	}
+	if !deleted {
+		return &registryError{http.StatusConflict, fmt.Sprintf("function %s was changed on another node, retry", current.Name)}
+	}
+
+	delete(fr.functions, current.Name)
+	fr.publishChange(registryChange{Name: current.Name, Generation: generation, Deleted: true})
+	return nil
+}
+
+func (fr *FunctionRegistry) publishChange(change registryChange) {
+	change.Origin = fr.nodeID
+	if err := fr.redisClient.PublishMessage(registryChannel, change); err != nil {
+		log.Printf("Failed to publish change of function %s: %v", change.Name, err)
+	}
+}
+
+// startSubscriber applies changes made on other replicas
+func (fr *FunctionRegistry) startSubscriber() {
+	for msg := range fr.pubsub.Channel() {
+		var change registryChange
+		if err := json.Unmarshal([]byte(msg.Payload), &change); err != nil {
+			log.Printf("Failed to decode registry change: %v", err)
+			continue
+		}
+		if change.Origin == fr.nodeID {
+			continue
+		}
+		fr.applyChange(change)
+	}
+}
+
+func (fr *FunctionRegistry) applyChange(change registryChange) {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+
+	if current, exists := fr.functions[change.Name]; exists && current.Generation >= change.Generation {
+		return
+	}
+
+	if change.Deleted {
+		delete(fr.functions, change.Name)
+	} else if change.Function != nil {
+		fr.functions[change.Name] = change.Function
+	}
+}
+
+// startResync reloads the registry from Redis periodically, in case change
+// notifications were missed while the subscription was down
+func (fr *FunctionRegistry) startResync() {
+	if fr.resyncInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(fr.resyncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := fr.resync(false); err != nil {
+			log.Printf("Failed to resync functions from Redis: %v", err)
+		}
+	}
+}
+
+// resync brings the local registry in line with Redis. Nothing is loaded if
+// no function changed since the last resync, unless force is set. Local
+// copies newer than the snapshot are kept.
+func (fr *FunctionRegistry) resync(force bool) error {
+	generation, err := fr.redisClient.GetFunctionGeneration()
+	if err != nil {
+		return err
+	}
+
+	fr.mutex.RLock()
+	unchanged := generation == fr.syncedGeneration
+	fr.mutex.RUnlock()
+	if unchanged && !force {
+		return nil
+	}
+
+	functions, err := fr.redisClient.GetAllFunctions()
+	if err != nil {
+		return err
+	}
+
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+
+	stored := make(map[string]bool, len(functions))
+	updated, removed := 0, 0
+	for _, function := range functions {
+		stored[function.Name] = true
+		if current, exists := fr.functions[function.Name]; !exists || current.Generation < function.Generation {
+			fr.functions[function.Name] = function
+			updated++
+		}
+	}
+	for name := range fr.functions {
+		if stored[name] {
+			continue
+		}
+		// The function may have been stored after the snapshot was taken
+		if _, err := fr.redisClient.GetFunction(name); err == goredis.Nil {
+			delete(fr.functions, name)
+			removed++
+		}
+	}
+
+	if generation > fr.syncedGeneration {
+		fr.syncedGeneration = generation
+	}
+	fr.resyncs++
+
+	if !force && (updated > 0 || removed > 0) {
+		log.Printf("Resync from Redis updated %d and removed %d functions", updated, removed)
+	}
+	return nil
+}
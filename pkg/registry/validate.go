@@ -0,0 +1,324 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"virtualization-manager/pkg/ratelimit"
+	"virtualization-manager/pkg/types"
+)
+
+// Function names and version labels appear in invoke paths, where "@"
+// separates a function name from an alias or revision
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,127}$`)
+
+// Methods a function may be called with
+var functionMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// FieldError is one rejected field of a function definition
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError collects every rejected field of a definition, so callers
+// can fix them all at once
+type validationError struct {
+	fields []FieldError
+}
+
+func (e *validationError) add(field, format string, args ...interface{}) {
+	e.fields = append(e.fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *validationError) Error() string {
+	messages := make([]string, len(e.fields))
+	for i, field := range e.fields {
+		messages[i] = field.Field + " " + field.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// result returns e if any field was rejected
+func (e *validationError) result() error {
+	if len(e.fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// durationFields are the definition fields holding a types.Duration. The
+// JSON decoder does not report which field a custom type rejected.
+var durationFields = []string{"timeout", "retry.initial_backoff", "retry.max_backoff", "retry.deadline"}
+
+// decodeDefinition reads a function definition, rejecting unknown fields
+// and values of the wrong type
+func decodeDefinition(body io.Reader, function *types.Function) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return &registryError{http.StatusBadRequest, "Invalid JSON"}
+	}
+	return decodeDefinitionBytes(data, function)
+}
+
+// decodeDefinitionBytes is decodeDefinition for a definition in memory
+func decodeDefinitionBytes(data []byte, function *types.Function) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(function)
+	if err == nil {
+		return nil
+	}
+
+	errs := &validationError{}
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Type == reflect.TypeOf(types.Duration(0)):
+		var fields map[string]json.RawMessage
+		json.Unmarshal(data, &fields)
+		for _, field := range durationFields {
+			if raw := lookupField(fields, field); raw != nil {
+				var d types.Duration
+				if json.Unmarshal(raw, &d) != nil {
+					errs.add(field, `must be a duration such as "15s" or "500ms"`)
+				}
+			}
+		}
+	case errors.As(err, &typeErr):
+		errs.add(typeErr.Field, "must be of type %s", typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		errs.add(field, "is not a known field")
+	}
+	if len(errs.fields) == 0 {
+		return &registryError{http.StatusBadRequest, "Invalid JSON"}
+	}
+	return errs
+}
+
+// lookupField finds a dotted field such as "retry.deadline" in a JSON object
+func lookupField(fields map[string]json.RawMessage, field string) json.RawMessage {
+	name, rest, nested := strings.Cut(field, ".")
+	raw := fields[name]
+	if !nested || raw == nil {
+		return raw
+	}
+	var inner map[string]json.RawMessage
+	if json.Unmarshal(raw, &inner) != nil {
+		return nil
+	}
+	return lookupField(inner, rest)
+}
+
+// validateFunction checks a function definition and fills in its defaults
+func validateFunction(function *types.Function) error {
+	errs := &validationError{}
+
+	if function.Name == "" {
+		errs.add("name", "is required")
+	} else if !namePattern.MatchString(function.Name) {
+		errs.add("name", "must be at most 128 letters, digits, '.', '_' or '-' and start with a letter or digit")
+	}
+
+	if function.Version == "" {
+		function.Version = types.DefaultVersion
+	} else if !namePattern.MatchString(function.Version) {
+		errs.add("version", "must be at most 128 letters, digits, '.', '_' or '-' and start with a letter or digit")
+	}
+
+	prepareDefinition(function, errs)
+	validateAccessPolicy(function.Access, errs)
+	validateRateLimitPolicy(function.RateLimit, errs)
+
+	return errs.result()
+}
+
+// prepareDefinition fills in the defaults of a function's upstream settings
+// and validates them. It applies to functions and to their versions.
+func prepareDefinition(function *types.Function, errs *validationError) {
+	// Set default values
+	if function.Method == "" {
+		function.Method = "POST"
+	}
+	function.Method = strings.ToUpper(function.Method)
+	if !containsMethod(function.Method) {
+		errs.add("method", "must be one of %s", strings.Join(functionMethods, ", "))
+	}
+
+	if function.Timeout == 0 {
+		function.Timeout = types.Duration(30 * time.Second)
+	}
+	if function.Timeout < 0 {
+		errs.add("timeout", "must be positive")
+	}
+
+	for name, value := range function.Headers {
+		if !isHeaderName(name) {
+			errs.add("headers", "%q is not a valid header name", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			errs.add("headers."+name, "must not contain line breaks")
+		}
+	}
+
+	validateEndpoints(function, errs)
+	validateRetryPolicy(function.Retry, errs)
+}
+
+// validateRateLimitPolicy checks the limits in a function's rate limit
+// override
+func validateRateLimitPolicy(policy *types.RateLimitPolicy, errs *validationError) {
+	if policy == nil {
+		return
+	}
+
+	limits := []struct{ field, spec string }{
+		{"rate_limit.function", policy.Function},
+		{"rate_limit.client", policy.Client},
+		{"rate_limit.user", policy.User},
+	}
+	for _, limit := range limits {
+		if _, err := ratelimit.ParseLimit(limit.spec); err != nil {
+			errs.add(limit.field, `must be requests/period such as "100/1m", or "none"`)
+		}
+	}
+}
+
+// validateRetryPolicy checks a retry policy and fills in its defaults
+func validateRetryPolicy(policy *types.RetryPolicy, errs *validationError) {
+	if policy == nil {
+		return
+	}
+
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = 3
+	}
+	if policy.MaxAttempts < 1 || policy.MaxAttempts > 10 {
+		errs.add("retry.max_attempts", "must be between 1 and 10")
+	}
+
+	if policy.InitialBackoff == 0 {
+		policy.InitialBackoff = types.Duration(100 * time.Millisecond)
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = types.Duration(5 * time.Second)
+	}
+	if policy.Multiplier == 0 {
+		policy.Multiplier = 2
+	}
+	if policy.InitialBackoff < 0 {
+		errs.add("retry.initial_backoff", "must not be negative")
+	}
+	if policy.MaxBackoff < 0 {
+		errs.add("retry.max_backoff", "must not be negative")
+	}
+	if policy.Deadline < 0 {
+		errs.add("retry.deadline", "must not be negative")
+	}
+	if policy.Multiplier < 1 {
+		errs.add("retry.multiplier", "must be at least 1")
+	}
+
+	if policy.RetryableStatuses == nil {
+		policy.RetryableStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	for _, status := range policy.RetryableStatuses {
+		if status < 100 || status > 599 {
+			errs.add("retry.retryable_statuses", "invalid status %d", status)
+		}
+	}
+
+	if policy.RetryableErrors == nil {
+		policy.RetryableErrors = []string{types.RetryOnConnectionRefused, types.RetryOnConnectionReset, types.RetryOnEOF}
+	}
+	for _, kind := range policy.RetryableErrors {
+		switch kind {
+		case types.RetryOnConnectionRefused, types.RetryOnConnectionReset, types.RetryOnEOF, types.RetryOnTimeout:
+		default:
+			errs.add("retry.retryable_errors", "unknown error %q", kind)
+		}
+	}
+}
+
+// validateEndpoints checks a function's endpoints and load-balancing
+// strategy. A function registered with a list of endpoints also gets its
+// first URL as endpoint, for clients that only read that field.
+func validateEndpoints(function *types.Function, errs *validationError) {
+	if len(function.Endpoints) == 0 {
+		if function.Endpoint == "" {
+			errs.add("endpoint", "is required unless endpoints is set")
+		} else if !isUpstreamURL(function.Endpoint) {
+			errs.add("endpoint", "must be an http or https URL")
+		}
+		return
+	}
+
+	seen := make(map[string]bool, len(function.Endpoints))
+	for i := range function.Endpoints {
+		endpoint := &function.Endpoints[i]
+		field := fmt.Sprintf("endpoints[%d]", i)
+
+		if !isUpstreamURL(endpoint.URL) {
+			errs.add(field+".url", "must be an http or https URL")
+		}
+		if seen[endpoint.URL] {
+			errs.add(field+".url", "is listed twice")
+		}
+		seen[endpoint.URL] = true
+
+		if endpoint.Weight < 0 {
+			errs.add(field+".weight", "must not be negative")
+		}
+		if endpoint.Weight == 0 {
+			endpoint.Weight = 1
+		}
+		endpoint.Healthy = true
+	}
+
+	switch function.Balancing {
+	case "":
+		function.Balancing = types.BalanceRoundRobin
+	case types.BalanceRoundRobin, types.BalanceWeighted, types.BalanceLeastInFlight, types.BalanceConsistentHash:
+	default:
+		errs.add("load_balancing", "must be one of %s, %s, %s, %s",
+			types.BalanceRoundRobin, types.BalanceWeighted, types.BalanceLeastInFlight, types.BalanceConsistentHash)
+	}
+
+	function.Endpoint = function.Endpoints[0].URL
+}
+
+func isUpstreamURL(raw string) bool {
+	parsed, err := url.Parse(raw)
+	return err == nil && parsed.Host != "" && (parsed.Scheme == "http" || parsed.Scheme == "https")
+}
+
+func containsMethod(method string) bool {
+	for _, allowed := range functionMethods {
+		if method == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// isHeaderName reports whether name is a valid HTTP header field name
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
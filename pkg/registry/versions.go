@@ -0,0 +1,266 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"virtualization-manager/pkg/types"
+
+	"github.com/gorilla/mux"
+)
+
+// primaryVersion is the version label of a function's top-level definition
+func primaryVersion(function *types.Function) string {
+	if function.Version == "" {
+		return types.DefaultVersion
+	}
+	return function.Version
+}
+
+// versionDefinition returns the definition of one version of a function
+func versionDefinition(function *types.Function, version string) (*types.Function, bool) {
+	if version == primaryVersion(function) {
+		return function, true
+	}
+	definition, exists := function.Versions[version]
+	return definition, exists
+}
+
+// SelectVersion picks the version that serves an invocation according to
+// the function's traffic split. Sticky splits hash the client ID so a
+// client keeps seeing the same version while the weights are unchanged.
+// A version that fails its health checks falls back to the primary.
+func (fr *FunctionRegistry) SelectVersion(function *types.Function, clientID string) *types.Function {
+	if function.Traffic == nil || len(function.Traffic.Weights) == 0 {
+		return function
+	}
+
+	// Sort for a stable order, which sticky routing depends on
+	versions := make([]string, 0, len(function.Traffic.Weights))
+	total := 0
+	for version, weight := range function.Traffic.Weights {
+		if weight > 0 {
+			versions = append(versions, version)
+			total += weight
+		}
+	}
+	if total == 0 {
+		return function
+	}
+	sort.Strings(versions)
+
+	var n int
+	if function.Traffic.Sticky && clientID != "" {
+		h := fnv.New32a()
+		h.Write([]byte(function.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(clientID))
+		n = int(h.Sum32() % uint32(total))
+	} else {
+		n = rand.Intn(total)
+	}
+
+	for _, version := range versions {
+		n -= function.Traffic.Weights[version]
+		if n < 0 {
+			if definition, exists := versionDefinition(function, version); exists && definition.IsActive {
+				return definition
+			}
+			break
+		}
+	}
+	return function
+}
+
+// AddVersion registers a new version of a function. The version gets no
+// traffic until the split is updated.
+func (fr *FunctionRegistry) AddVersion(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var definition types.Function
+	if err := decodeDefinition(r.Body, &definition); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	errs := &validationError{}
+	if definition.Version == "" {
+		errs.add("version", "is required")
+	} else if !namePattern.MatchString(definition.Version) {
+		errs.add("version", "must be at most 128 letters, digits, '.', '_' or '-' and start with a letter or digit")
+	}
+	prepareDefinition(&definition, errs)
+	restoreRedactedHeaders(&definition, nil, errs)
+	if err := errs.result(); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	// Access, rate limits and the traffic split belong to the function
+	definition.Name = name
+	definition.Access = nil
+	definition.RateLimit = nil
+	definition.Versions = nil
+	definition.Traffic = nil
+	definition.Circuit = nil
+	definition.Aliases = nil
+	definition.Disabled = false
+	definition.IsActive = true
+	definition.CreatedAt = time.Now()
+	definition.UpdatedAt = definition.CreatedAt
+
+	updated, err := fr.updateFunction(name, func(function *types.Function) error {
+		if _, exists := versionDefinition(function, definition.Version); exists {
+			return &registryError{http.StatusConflict, fmt.Sprintf("version %s of %s already exists", definition.Version, name)}
+		}
+		function.Versions = copyVersions(function.Versions)
+		function.Versions[definition.Version] = &definition
+		return nil
+	})
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	log.Printf("Added version %s of function %s at %s", definition.Version, name, definition.Endpoint)
+	writeTraffic(w, http.StatusCreated, updated)
+}
+
+// RemoveVersion deletes a version that receives no traffic
+func (fr *FunctionRegistry) RemoveVersion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, version := vars["name"], vars["version"]
+
+	updated, err := fr.updateFunction(name, func(function *types.Function) error {
+		if version == primaryVersion(function) {
+			return &registryError{http.StatusConflict, fmt.Sprintf("version %s is the primary version of %s", version, name)}
+		}
+		if _, exists := function.Versions[version]; !exists {
+			return &registryError{http.StatusNotFound, fmt.Sprintf("version %s of %s not found", version, name)}
+		}
+		if function.Traffic != nil && function.Traffic.Weights[version] > 0 {
+			return &registryError{http.StatusConflict, fmt.Sprintf("version %s still receives traffic", version)}
+		}
+
+		function.Versions = copyVersions(function.Versions)
+		delete(function.Versions, version)
+		if function.Traffic != nil {
+			function.Traffic = copyTraffic(function.Traffic)
+			delete(function.Traffic.Weights, version)
+		}
+		return nil
+	})
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	if err := fr.redisClient.DeleteBreakerState(breakerKey(name, version)); err != nil {
+		log.Printf("Failed to delete circuit state for %s: %v", breakerKey(name, version), err)
+	}
+
+	log.Printf("Removed version %s of function %s", version, name)
+	writeTraffic(w, http.StatusOK, updated)
+}
+
+// SetTraffic replaces a function's traffic split
+func (fr *FunctionRegistry) SetTraffic(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var split types.TrafficSplit
+	if err := json.NewDecoder(r.Body).Decode(&split); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	updated, err := fr.updateFunction(name, func(function *types.Function) error {
+		total := 0
+		for version, weight := range split.Weights {
+			if _, exists := versionDefinition(function, version); !exists {
+				return &registryError{http.StatusBadRequest, fmt.Sprintf("unknown version %s", version)}
+			}
+			if weight < 0 {
+				return &registryError{http.StatusBadRequest, "weights must not be negative"}
+			}
+			total += weight
+		}
+		if total == 0 {
+			return &registryError{http.StatusBadRequest, "at least one version needs a positive weight"}
+		}
+
+		function.Traffic = &split
+		return nil
+	})
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	log.Printf("Updated traffic split of function %s: %v", name, split.Weights)
+	writeTraffic(w, http.StatusOK, updated)
+}
+
+// Rollback sends all of a function's traffic back to its primary version
+func (fr *FunctionRegistry) Rollback(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	updated, err := fr.updateFunction(name, func(function *types.Function) error {
+		sticky := function.Traffic != nil && function.Traffic.Sticky
+		function.Traffic = &types.TrafficSplit{
+			Weights: map[string]int{primaryVersion(function): 100},
+			Sticky:  sticky,
+		}
+		return nil
+	})
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	log.Printf("Rolled back function %s to version %s", name, primaryVersion(updated))
+	writeTraffic(w, http.StatusOK, updated)
+}
+
+// writeTraffic reports a function's versions and traffic split without the
+// version definitions, which may hold upstream credentials
+func writeTraffic(w http.ResponseWriter, status int, function *types.Function) {
+	versions := []string{primaryVersion(function)}
+	for version := range function.Versions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":            function.Name,
+		"primary_version": primaryVersion(function),
+		"versions":        versions,
+		"traffic":         function.Traffic,
+	})
+}
+
+func copyVersions(versions map[string]*types.Function) map[string]*types.Function {
+	copied := make(map[string]*types.Function, len(versions)+1)
+	for version, definition := range versions {
+		copied[version] = definition
+	}
+	return copied
+}
+
+func copyTraffic(split *types.TrafficSplit) *types.TrafficSplit {
+	copied := &types.TrafficSplit{
+		Weights: make(map[string]int, len(split.Weights)),
+		Sticky:  split.Sticky,
+	}
+	for version, weight := range split.Weights {
+		copied.Weights[version] = weight
+	}
+	return copied
+}
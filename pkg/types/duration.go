@@ -0,0 +1,38 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Duration is a time.Duration written as a string such as "15s" in JSON.
+// Plain numbers are read as nanoseconds, which is how definitions stored
+// before durations were strings encoded them.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return &json.UnmarshalTypeError{Value: "string " + strconv.Quote(v), Type: reflect.TypeOf(*d)}
+		}
+		*d = Duration(parsed)
+	case float64:
+		*d = Duration(v)
+	default:
+		return &json.UnmarshalTypeError{Value: string(data), Type: reflect.TypeOf(*d)}
+	}
+	return nil
+}
@@ -4,16 +4,54 @@ import (
 	"time"
 )
 
-// Connection represents an active SSE connection
+// Connection represents an active client connection on any transport
 type Connection struct {
-	ID        string            `json:"id"`
-	ClientID  string            `json:"client_id"`
-	UserID    string            `json:"user_id,omitempty"`
-	Channel   chan SSEMessage   `json:"-"`
-	Metadata  map[string]string `json:"metadata"`
-	CreatedAt time.Time         `json:"created_at"`
-	LastPing  time.Time         `json:"last_ping"`
-	Active    bool              `json:"active"`
+	ID              string             `json:"id"`
+	ClientID        string             `json:"client_id"`
+	UserID          string             `json:"user_id,omitempty"`
+	Transport       string             `json:"transport"`
+	Channel         chan SSEMessage    `json:"-"`
+	Done            chan struct{}      `json:"-"` // Closed when the connection is removed
+	Metadata        map[string]string  `json:"metadata"`
+	Topics          []string           `json:"topics,omitempty"`
+	Filter          *EventFilter       `json:"filter,omitempty"`
+	Backpressure    BackpressurePolicy `json:"backpressure"`
+	DroppedMessages uint64             `json:"dropped_messages"` // Updated atomically
+	PendingOverflow uint64             `json:"-"`                // Drops not yet reported to the client
+	CreatedAt       time.Time          `json:"created_at"`
+	LastPing        time.Time          `json:"last_ping"`
+	Active          bool               `json:"active"`
+}
+
+// Transports a connection can be served over
+const (
+	TransportSSE       = "sse"
+	TransportWebSocket = "websocket"
+	TransportLongPoll  = "long_poll"
+)
+
+// BackpressurePolicy decides what happens when a connection's buffer is full
+type BackpressurePolicy string
+
+const (
+	BackpressureDropNewest BackpressurePolicy = "drop_newest"
+	BackpressureDropOldest BackpressurePolicy = "drop_oldest"
+	BackpressureBlock      BackpressurePolicy = "block"
+	BackpressureDisconnect BackpressurePolicy = "disconnect"
+)
+
+// EventFilter selects which messages a connection receives. A message
+// passes when its event is in Events (if set) and every predicate matches.
+type EventFilter struct {
+	Events     []string         `json:"events,omitempty"`
+	Predicates []FieldPredicate `json:"predicates,omitempty"`
+}
+
+// FieldPredicate compares a dotted field path in the message data to a value
+type FieldPredicate struct {
+	Field    string `json:"field"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
 }
 
 // SSEMessage represents a message sent over SSE
@@ -26,15 +64,133 @@ type SSEMessage struct {
 
 // Function represents a registered serverless function
 type Function struct {
-	Name        string            `json:"name"`
-	Endpoint    string            `json:"endpoint"`
-	Method      string            `json:"method"`
-	Timeout     time.Duration     `json:"timeout"`
-	Headers     map[string]string `json:"headers"`
-	Description string            `json:"description"`
-	IsActive    bool              `json:"is_active"`
-	CreatedAt   time.Time         `json:"created_at"`
-	UpdatedAt   time.Time         `json:"updated_at"`
+	Name        string                    `json:"name"`
+	Endpoint    string                    `json:"endpoint"`
+	Endpoints   []Endpoint                `json:"endpoints,omitempty"`
+	Balancing   string                    `json:"load_balancing,omitempty"`
+	Method      string                    `json:"method"`
+	Timeout     Duration                  `json:"timeout"`
+	Headers     map[string]string         `json:"headers"`
+	Description string                    `json:"description"`
+	Streaming   bool                      `json:"streaming"`
+	Access      *AccessPolicy             `json:"access,omitempty"`
+	RateLimit   *RateLimitPolicy          `json:"rate_limit,omitempty"`
+	Retry       *RetryPolicy              `json:"retry,omitempty"`
+	Version     string                    `json:"version,omitempty"`
+	Versions    map[string]*Function      `json:"versions,omitempty"`
+	Traffic     *TrafficSplit             `json:"traffic,omitempty"`
+	Revision    int                       `json:"revision,omitempty"`
+	Generation  int64                     `json:"generation,omitempty"`
+	Aliases     map[string]*FunctionAlias `json:"aliases,omitempty"`
+	Circuit     *CircuitStatus            `json:"circuit,omitempty"`
+	IsActive    bool                      `json:"is_active"`
+	Disabled    bool                      `json:"disabled,omitempty"`
+	Source      string                    `json:"source,omitempty"`
+	CreatedAt   time.Time                 `json:"created_at"`
+	UpdatedAt   time.Time                 `json:"updated_at"`
+}
+
+// DefaultVersion labels a function registered without a version
+const DefaultVersion = "v1"
+
+// Where a function's definition comes from
+const (
+	SourceAPI  = "api"
+	SourceFile = "file"
+)
+
+// TrafficSplit routes a function's invocations across its versions in
+// proportion to Weights. Sticky keeps each client ID on one version.
+type TrafficSplit struct {
+	Weights map[string]int `json:"weights"`
+	Sticky  bool           `json:"sticky"`
+}
+
+// FunctionAlias is a named pointer to a function revision, such as "prod".
+// History holds the revisions it pointed to before, most recent last.
+type FunctionAlias struct {
+	Revision  int       `json:"revision"`
+	History   []int     `json:"history,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Endpoint is one upstream serving a function
+type Endpoint struct {
+	URL             string    `json:"url"`
+	Weight          int       `json:"weight"`
+	Healthy         bool      `json:"healthy"`
+	LastHealthCheck time.Time `json:"last_health_check,omitempty"`
+}
+
+// Load-balancing strategies across a function's endpoints
+const (
+	BalanceRoundRobin     = "round_robin"
+	BalanceWeighted       = "weighted"
+	BalanceLeastInFlight  = "least_in_flight"
+	BalanceConsistentHash = "consistent_hash"
+)
+
+// Function visibility
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+)
+
+// AccessPolicy restricts who may invoke a function. Every rule that is set
+// must match; a function without a policy can be invoked by anyone.
+type AccessPolicy struct {
+	Visibility string            `json:"visibility,omitempty"`
+	Users      []string          `json:"users,omitempty"`
+	Roles      []string          `json:"roles,omitempty"`
+	Claims     map[string]string `json:"claims,omitempty"`
+	ClientIDs  []string          `json:"client_ids,omitempty"`
+}
+
+// RateLimitPolicy overrides the default invocation rate limits for one
+// function. Limits are written as "requests/period", e.g. "100/1m"; "none"
+// disables a limit and an empty value keeps the default.
+type RateLimitPolicy struct {
+	Function string `json:"function,omitempty"`
+	Client   string `json:"client,omitempty"`
+	User     string `json:"user,omitempty"`
+}
+
+// Network errors a retry policy can treat as retryable
+const (
+	RetryOnConnectionRefused = "connection_refused"
+	RetryOnConnectionReset   = "connection_reset"
+	RetryOnEOF               = "eof"
+	RetryOnTimeout           = "timeout"
+)
+
+// RetryPolicy retries failed upstream calls with exponential backoff and
+// jitter. Calls with a method that is not idempotent are only retried if
+// NonIdempotent is set.
+type RetryPolicy struct {
+	MaxAttempts       int      `json:"max_attempts"`
+	InitialBackoff    Duration `json:"initial_backoff"`
+	MaxBackoff        Duration `json:"max_backoff"`
+	Multiplier        float64  `json:"multiplier"`
+	RetryableStatuses []int    `json:"retryable_statuses"`
+	RetryableErrors   []string `json:"retryable_errors"`
+	Deadline          Duration `json:"deadline,omitempty"`
+	NonIdempotent     bool     `json:"non_idempotent,omitempty"`
+}
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// CircuitStatus is a function's circuit breaker state as shared in Redis
+type CircuitStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	WindowRequests      int        `json:"window_requests"`
+	WindowFailures      int        `json:"window_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
 }
 
 // InvocationRequest represents a function invocation request
@@ -44,6 +200,10 @@ type InvocationRequest struct {
 	ClientID     string                 `json:"client_id,omitempty"`
 	Async        bool                   `json:"async"`
 	Timeout      int                    `json:"timeout,omitempty"`
+
+	// Verified caller, filled in by the gateway and never read from the body
+	UserID string                 `json:"-"`
+	Claims map[string]interface{} `json:"-"`
 }
 
 // InvocationResponse represents a function invocation response
@@ -53,14 +213,93 @@ type InvocationResponse struct {
 	Error     string      `json:"error,omitempty"`
 	Duration  int64       `json:"duration_ms"`
 	RequestID string      `json:"request_id"`
+
+	// HTTP status returned by the function, if it responded
+	StatusCode int    `json:"status_code,omitempty"`
+	Attempts   int    `json:"attempts,omitempty"`
+	Version    string `json:"version,omitempty"`
+	Revision   int    `json:"revision,omitempty"`
+}
+
+// PublishRequest is the body of a topic publish call
+type PublishRequest struct {
+	Event string      `json:"event,omitempty"`
+	Data  interface{} `json:"data"`
+}
+
+// TopicSubscriptionRequest lists topics to add to a connection
+type TopicSubscriptionRequest struct {
+	Topics []string `json:"topics"`
+}
+
+// PollResponse is a batch of messages returned to a long-polling client.
+// Cursor is passed back on the next poll.
+type PollResponse struct {
+	ConnectionID string       `json:"connection_id"`
+	Cursor       string       `json:"cursor"`
+	Messages     []SSEMessage `json:"messages"`
+}
+
+// WebSocketFrame is a message sent by a WebSocket client. Type is one of
+// invoke, subscribe, unsubscribe or ping; Ref is echoed back in replies.
+type WebSocketFrame struct {
+	Type     string                 `json:"type"`
+	Ref      string                 `json:"ref,omitempty"`
+	Function string                 `json:"function,omitempty"`
+	Payload  map[string]interface{} `json:"payload,omitempty"`
+	Timeout  int                    `json:"timeout,omitempty"`
+	Topics   []string               `json:"topics,omitempty"`
+}
+
+// FunctionChunk is a piece of streamed function output, relayed to clients
+// as a function_chunk event before the final function_response
+type FunctionChunk struct {
+	RequestID string      `json:"request_id"`
+	Sequence  int         `json:"sequence"`
+	Event     string      `json:"event,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// AsyncInvocationResponse acknowledges an invocation accepted for background
+// execution; the result is delivered later over SSE
+type AsyncInvocationResponse struct {
+	Success   bool   `json:"success"`
+	RequestID string `json:"request_id"`
+	Message   string `json:"message"`
+	ClientID  string `json:"client_id"`
+}
+
+// InvocationStatus is the lifecycle state of an invocation
+type InvocationStatus string
+
+const (
+	InvocationQueued    InvocationStatus = "queued"
+	InvocationRunning   InvocationStatus = "running"
+	InvocationSucceeded InvocationStatus = "succeeded"
+	InvocationFailed    InvocationStatus = "failed"
+	InvocationTimedOut  InvocationStatus = "timed_out"
+)
+
+// InvocationRecord tracks an invocation so its result can be polled or
+// recovered after a reconnect
+type InvocationRecord struct {
+	RequestID    string              `json:"request_id"`
+	FunctionName string              `json:"function_name"`
+	ClientID     string              `json:"client_id,omitempty"`
+	UserID       string              `json:"user_id,omitempty"`
+	Async        bool                `json:"async"`
+	Status       InvocationStatus    `json:"status"`
+	Response     *InvocationResponse `json:"response,omitempty"`
+	CreatedAt    time.Time           `json:"created_at"`
+	UpdatedAt    time.Time           `json:"updated_at"`
 }
 
 // HealthStatus represents system health status
 type HealthStatus struct {
-	Status           string            `json:"status"`
-	ActiveConnections int              `json:"active_connections"`
-	RegisteredFunctions int            `json:"registered_functions"`
-	RedisConnected   bool              `json:"redis_connected"`
-	Uptime           time.Duration     `json:"uptime"`
-	Metrics          map[string]interface{} `json:"metrics"`
+	Status              string                 `json:"status"`
+	ActiveConnections   int                    `json:"active_connections"`
+	RegisteredFunctions int                    `json:"registered_functions"`
+	RedisConnected      bool                   `json:"redis_connected"`
+	Uptime              time.Duration          `json:"uptime"`
+	Metrics             map[string]interface{} `json:"metrics,omitempty"`
 }